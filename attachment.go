@@ -0,0 +1,202 @@
+package sendme
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// attachmentResolver expands attachment paths: templated path, relative
+// to attachment root, glob pattern or directory. Each match becomes an attachment.
+type attachmentResolver struct {
+	root    string
+	maxSize int64
+	tpls    map[string]*template.Template
+	// option of templated paths, e.g. missingkey
+	opt string
+}
+
+func newAttachmentResolver(conf *DeliveryConfig) (*attachmentResolver, error) {
+	r := attachmentResolver{
+		root: conf.AttachmentRoot,
+		tpls: make(map[string]*template.Template),
+	}
+	if conf.MaxAttachmentSize != "" {
+		size, err := parseSize(conf.MaxAttachmentSize)
+		if err != nil {
+			return nil, fmt.Errorf("parsing max attachment size `%s` error: %w", conf.MaxAttachmentSize, err)
+		}
+		r.maxSize = size
+	}
+	return &r, nil
+}
+
+// Resolve returns attachments of the row. All problems, i.e. missing,
+// unreadable or too large files, are returned as ValidationError.
+func (r *attachmentResolver) Resolve(datum MailData) ([]*AttachmentFile, error) {
+	var files []*AttachmentFile
+	var verr ValidationError
+	for _, af := range datum.AttachmentFiles() {
+		if af.FilePath == "" {
+			continue
+		}
+		path, err := r.expand(af.FilePath, datum)
+		if err != nil {
+			verr = append(verr, &FieldError{Column: af.Key, Value: af.FilePath, Reason: err.Error()})
+			continue
+		}
+		matches, err := r.match(path)
+		if err != nil {
+			verr = append(verr, &FieldError{Column: af.Key, Value: path, Reason: err.Error()})
+			continue
+		}
+		for _, match := range matches {
+			if err := r.check(match); err != nil {
+				verr = append(verr, &FieldError{Column: af.Key, Value: match, Reason: err.Error()})
+				continue
+			}
+			file := AttachmentFile{
+				Key:      af.Key,
+				FilePath: match,
+				Inline:   af.Inline,
+			}
+			// name only applies to single file
+			if len(matches) == 1 {
+				file.Name = af.Name
+			}
+			files = append(files, &file)
+		}
+	}
+	if len(verr) > 0 {
+		return files, verr
+	}
+	return files, nil
+}
+
+// option sets option of templated paths, including paths parsed later
+func (r *attachmentResolver) option(opt string) {
+	r.opt = opt
+	for _, tpl := range r.tpls {
+		tpl.Option(opt)
+	}
+}
+
+// expand executes templated path and joins it with attachment root
+func (r *attachmentResolver) expand(path string, datum MailData) (string, error) {
+	if strings.Contains(path, "{{") {
+		tpl, ok := r.tpls[path]
+		if !ok {
+			var err error
+			tpl, err = template.New("attachment").Funcs(sprig.TxtFuncMap()).Parse(path)
+			if err != nil {
+				return "", fmt.Errorf("parse path template error: %w", err)
+			}
+			if r.opt != "" {
+				tpl.Option(r.opt)
+			}
+			r.tpls[path] = tpl
+		}
+		var sb strings.Builder
+		if err := tpl.Execute(&sb, datum); err != nil {
+			return "", fmt.Errorf("execute path template error: %w", err)
+		}
+		path = strings.TrimSpace(sb.String())
+	}
+	if r.root != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(r.root, path)
+	}
+	return path, nil
+}
+
+// match expands glob pattern and directory into list of files
+func (r *attachmentResolver) match(path string) ([]string, error) {
+	paths := []string{path}
+	if strings.ContainsAny(path, "*?[") {
+		var err error
+		paths, err = filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no file matches pattern")
+		}
+	}
+
+	files := []string{}
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("file not found: %w", err)
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, fmt.Errorf("read directory error: %w", err)
+		}
+		n := 0
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				files = append(files, filepath.Join(p, e.Name()))
+				n++
+			}
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("directory %s is empty", p)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// check file is readable and not larger than limit
+func (r *attachmentResolver) check(filename string) error {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("file not readable: %w", err)
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return fmt.Errorf("stat file error: %w", err)
+	}
+	if r.maxSize > 0 && fi.Size() > r.maxSize {
+		return fmt.Errorf("file size %d exceeds limit %d bytes", fi.Size(), r.maxSize)
+	}
+	return nil
+}
+
+// parseSize parses size, e.g. 512KB, 10MB, 1GB or number of bytes
+func parseSize(str string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(str))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", str)
+	}
+	return int64(n * float64(mult)), nil
+}
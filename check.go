@@ -0,0 +1,351 @@
+package sendme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"text/template/parse"
+)
+
+// Kind of problem found by Validate
+const (
+	ProblemSkip       = "skip"
+	ProblemMissingKey = "missing key"
+	ProblemRender     = "render"
+	ProblemAddress    = "address"
+	ProblemAttachment = "attachment"
+)
+
+// RowProblem is a problem of a row found by Validate
+type RowProblem struct {
+	Row     int
+	Key     string
+	Kind    string
+	Message string
+}
+
+func (p *RowProblem) String() string {
+	if p.Key != "" {
+		return fmt.Sprintf("row #%d (%s) [%s]: %s", p.Row, p.Key, p.Kind, p.Message)
+	}
+	return fmt.Sprintf("row #%d [%s]: %s", p.Row, p.Kind, p.Message)
+}
+
+// CheckReport lists all problems found by Validate
+type CheckReport struct {
+	Total         int
+	Problems      []*RowProblem
+	UnusedColumns []string
+}
+
+// NumSkip returns number of rows which would be skipped
+func (r *CheckReport) NumSkip() int {
+	n := 0
+	for _, p := range r.Problems {
+		if p.Kind == ProblemSkip {
+			n++
+		}
+	}
+	return n
+}
+
+// Err returns error if there is a problem which would fail sending.
+// Skipped rows and unused columns are not errors.
+func (r *CheckReport) Err() error {
+	lines := []string{}
+	for _, p := range r.Problems {
+		if p.Kind != ProblemSkip {
+			lines = append(lines, p.String())
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return fmt.Errorf("check failed, %d problem(s) found:\n  %s", len(lines), strings.Join(lines, "\n  "))
+}
+
+// String formats report for display
+func (r *CheckReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Checked %d row(s): %d problem(s), %d skipped\n",
+		r.Total, len(r.Problems)-r.NumSkip(), r.NumSkip())
+	for _, p := range r.Problems {
+		fmt.Fprintf(&sb, "  %s\n", p)
+	}
+	if len(r.UnusedColumns) > 0 {
+		fmt.Fprintf(&sb, "Unused column(s): %s\n", strings.Join(r.UnusedColumns, ", "))
+	}
+	return sb.String()
+}
+
+func (r *CheckReport) add(row int, key, kind string, err error) {
+	r.Problems = append(r.Problems, &RowProblem{
+		Row:     row,
+		Key:     key,
+		Kind:    kind,
+		Message: err.Error(),
+	})
+}
+
+// Validate renders subject, headers and body of every row without sending.
+// Missing keys, skipped rows, invalid addresses, attachment problems and
+// unused data columns are collected into one report. Returned error is
+// for failure which prevents checking, e.g. invalid template or data.
+func (m *Mailer) Validate(ctx context.Context) (*CheckReport, error) {
+	if err := m.parseTemplates(); err != nil {
+		return nil, err
+	}
+	src, err := OpenRowSource(m.conf)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	// missing key is reported instead of rendered as <no value>
+	m.setMissingKey("error")
+	defer m.setMissingKey("default")
+
+	d := m.conf.Delivery
+	report := CheckReport{}
+	columns := map[string]bool{}
+	for row := 1; ; row++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		datum, err := src.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read data error: %w", err)
+		}
+		report.Total++
+
+		key := datum.StringDefault(d.KeyDataField, datum.StringDefault(d.ToDataField, ""))
+		if err := m.schema.Apply(datum); err != nil {
+			report.add(row, key, ProblemSkip, fmt.Errorf("invalid data: %w", err))
+			continue
+		}
+		for col := range datum {
+			columns[col] = true
+		}
+		if missing := datum.MissingFields(d.RequiredFields); len(missing) > 0 {
+			report.add(row, key, ProblemSkip, fmt.Errorf("empty required field(s) %s", strings.Join(missing, ", ")))
+			continue
+		}
+		sel, err := m.localeSelector(datum).Select(datum, datum.StringDefault(d.ToDataField, ""))
+		if err != nil {
+			report.add(row, key, ProblemSkip, err)
+			continue
+		}
+
+		for _, err := range m.checkAddresses(datum) {
+			report.add(row, key, ProblemAddress, err)
+		}
+		if _, err := m.render(datum, sel); err != nil {
+			report.add(row, key, renderProblem(err), err)
+		}
+		if _, err := sel.headers.render(datum, d.SubjectDataField); err != nil {
+			report.add(row, key, renderProblem(err), err)
+		}
+		if !d.SkipAttachmentCheck {
+			if _, err := m.attach.Resolve(datum); err != nil {
+				report.add(row, key, ProblemAttachment, err)
+			}
+		}
+	}
+
+	report.UnusedColumns = m.unusedColumns(columns)
+	return &report, nil
+}
+
+// checkAddresses validates addresses of the row as used when sending
+func (m *Mailer) checkAddresses(datum MailData) []error {
+	d := m.conf.Delivery
+	var errs []error
+	toVals := datum.StringDefault(d.ToDataField, "")
+	if toVals == "" {
+		errs = append(errs, fmt.Errorf("destination address not found/field `%s` is empty", d.ToDataField))
+	} else if _, err := ParseAddressList(toVals); err != nil {
+		errs = append(errs, fmt.Errorf("parse address `%s` error: %w", toVals, err))
+	}
+	for _, field := range []string{d.CcDataField, d.BccDataField} {
+		if _, err := datum.AddressField(field); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, field := range []string{d.FromDataField, d.SenderDataField, d.ReplyToDataField} {
+		if _, err := singleAddress(datum, field, ""); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func renderProblem(err error) string {
+	if strings.Contains(err.Error(), "map has no entry for key") {
+		return ProblemMissingKey
+	}
+	return ProblemRender
+}
+
+// setMissingKey sets missingkey option of all parsed templates
+func (m *Mailer) setMissingKey(mode string) {
+	opt := "missingkey=" + mode
+	for _, sel := range m.selectors {
+		setTemplateOption(sel.tpl, opt)
+		setTemplateOption(sel.textTpl, opt)
+		sel.headers.option(opt)
+		if sel.markdown != nil {
+			setTemplateOption(sel.markdown.layout, opt)
+		}
+	}
+	for _, g := range m.pdfs {
+		setTemplateOption(g.template(), opt)
+		g.nameTpl.Option(opt)
+	}
+	m.attach.option(opt)
+}
+
+func setTemplateOption(tpl Executer, opt string) {
+	switch t := tpl.(type) {
+	case *layoutTemplates:
+		for _, mt := range t.mains {
+			setTemplateOption(mt, opt)
+		}
+	case *htmltemplate.Template:
+		for _, at := range t.Templates() {
+			at.Option(opt)
+		}
+	case *texttemplate.Template:
+		for _, at := range t.Templates() {
+			at.Option(opt)
+		}
+	}
+}
+
+// unusedColumns returns data columns which are not referenced by
+// any template nor configuration.
+func (m *Mailer) unusedColumns(columns map[string]bool) []string {
+	used := map[string]bool{}
+	var trees []*parse.Tree
+	for _, sel := range m.selectors {
+		trees = append(trees, templateTrees(sel.tpl)...)
+		trees = append(trees, templateTrees(sel.textTpl)...)
+		for _, tpl := range sel.headers.templates() {
+			trees = append(trees, templateTrees(tpl)...)
+		}
+	}
+	for _, g := range m.pdfs {
+		trees = append(trees, templateTrees(g.template())...)
+		trees = append(trees, templateTrees(g.nameTpl)...)
+	}
+	for _, tree := range trees {
+		if tree != nil {
+			collectFields(tree.Root, used)
+		}
+	}
+
+	d := m.conf.Delivery
+	for _, field := range []string{
+		d.ToDataField, d.CcDataField, d.BccDataField, d.ReplyToDataField,
+		d.FromDataField, d.SenderDataField, d.SubjectDataField, d.KeyDataField,
+		d.TemplateDataField, d.LanguageDataField,
+	} {
+		used[field] = true
+	}
+	for _, field := range d.RequiredFields {
+		used[field] = true
+	}
+
+	unused := []string{}
+	for col := range columns {
+		if !used[col] && !strings.HasPrefix(strings.ToLower(col), AttachmentKeyPrefix) {
+			unused = append(unused, col)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+func templateTrees(tpl Executer) []*parse.Tree {
+	var trees []*parse.Tree
+	switch t := tpl.(type) {
+	case *layoutTemplates:
+		for _, mt := range t.mains {
+			trees = append(trees, templateTrees(mt)...)
+		}
+	case *htmltemplate.Template:
+		for _, at := range t.Templates() {
+			trees = append(trees, at.Tree)
+		}
+	case *texttemplate.Template:
+		for _, at := range t.Templates() {
+			trees = append(trees, at.Tree)
+		}
+	}
+	return trees
+}
+
+// collectFields collects field names (.Name, $.Name) and keys of
+// `index . "Name"` referenced in parse tree.
+func collectFields(node parse.Node, used map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			collectFields(c, used)
+		}
+	case *parse.ActionNode:
+		collectFields(n.Pipe, used)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			collectFields(c, used)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) > 1 {
+			if id, ok := n.Args[0].(*parse.IdentifierNode); ok && id.Ident == "index" {
+				for _, arg := range n.Args[2:] {
+					if s, ok := arg.(*parse.StringNode); ok {
+						used[s.Text] = true
+					}
+				}
+			}
+		}
+		for _, arg := range n.Args {
+			collectFields(arg, used)
+		}
+	case *parse.FieldNode:
+		used[n.Ident[0]] = true
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			used[n.Ident[1]] = true
+		}
+	case *parse.ChainNode:
+		collectFields(n.Node, used)
+	case *parse.IfNode:
+		collectBranch(&n.BranchNode, used)
+	case *parse.RangeNode:
+		collectBranch(&n.BranchNode, used)
+	case *parse.WithNode:
+		collectBranch(&n.BranchNode, used)
+	case *parse.TemplateNode:
+		collectFields(n.Pipe, used)
+	}
+}
+
+func collectBranch(n *parse.BranchNode, used map[string]bool) {
+	collectFields(n.Pipe, used)
+	collectFields(n.List, used)
+	collectFields(n.ElseList, used)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -14,18 +15,27 @@ import (
 	"github.com/ipsusila/sendme"
 	"github.com/k0kubun/pp"
 	"golang.org/x/term"
+	_ "modernc.org/sqlite"
 )
 
 var (
 	fConf       = flag.String("conf", "config.hjson", "Configuration file")
 	fConfirm    = flag.Bool("confirm", false, "Confirm before send")
 	fSendMode   = flag.Bool("send", false, "Sending mode, otherwise testing mode")
+	fPreview    = flag.String("preview", "", "Write messages as .eml files into directory, do not send")
 	fTestConfig = flag.Bool("testconf", false, "Test configuration, do not send email")
+	fPreflight  = flag.Bool("preflight", false, "Check every row before the first message is sent (otherwise run 'sendme check' first)")
 	fVerbose    = flag.Bool("verbose", false, "Verbose mode")
 )
 
 func main() {
-	flag.Parse()
+	// `sendme check [flags]` validates data and templates without sending
+	check := len(os.Args) > 1 && os.Args[1] == "check"
+	if check {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
 	start := time.Now()
 	conf, err := sendme.LoadConfig(*fConf)
@@ -34,38 +44,35 @@ func main() {
 	}
 
 	// Check for configuration validity
-	if conf.Server == nil {
+	if conf.UseSmtp() && len(conf.ServerList()) == 0 {
 		log.Fatalln("Server configuration not specified")
 	}
 	if conf.Delivery == nil {
 		log.Fatalln("Delivery configuration not specified")
 	}
 
-	// Prompt for username
-	if conf.Server.Username == "" {
-		fmt.Print("Username: ")
-		scanner := bufio.NewScanner(os.Stdin)
-		if scanner.Scan() {
-			conf.Server.Username = scanner.Text()
-		}
-		if err := scanner.Err(); err != nil {
-			log.Fatalf("Error scanning input: %v\n", err)
-		}
-
-		if u := strings.TrimSpace(conf.Server.Username); u == "" {
-			log.Fatalln("Username not specified")
-		}
+	// override config
+	if *fPreview != "" {
+		conf.Delivery.PreviewMode = true
+		conf.Delivery.PreviewDir = *fPreview
 	}
 
-	if conf.Server.Password == "" {
-		// scan password
-		fmt.Print("Password: ")
-		bytepw, err := term.ReadPassword(int(syscall.Stdin))
-		if err != nil {
-			os.Exit(1)
+	// Prompt for credentials of every server
+	if !conf.Delivery.PreviewMode && !check && conf.UseSmtp() {
+		servers := conf.ServerList()
+		for _, srv := range servers {
+			prefix := ""
+			if len(servers) > 1 {
+				prefix = fmt.Sprintf("[%s:%d] ", srv.Host, srv.Port)
+				if srv.Name != "" {
+					prefix = "[" + srv.Name + "] "
+				}
+				if strings.EqualFold(srv.Authentication, "NONE") {
+					continue
+				}
+			}
+			promptCredential(prefix, srv)
 		}
-		conf.Server.Password = string(bytepw)
-		fmt.Println()
 	}
 
 	// override config
@@ -78,6 +85,9 @@ func main() {
 	if !conf.Verbose {
 		conf.Verbose = *fVerbose
 	}
+	if *fPreflight {
+		conf.Delivery.PreflightCheck = true
+	}
 
 	// Create mailer
 	mailer, err := sendme.NewMailer(conf)
@@ -88,10 +98,21 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if *fTestConfig {
+	if check {
+		report, err := mailer.Validate(ctx)
+		if err != nil {
+			log.Fatalf("Error checking data: %v\n", err)
+		}
+		fmt.Print(report)
+		if report.Err() != nil {
+			os.Exit(1)
+		}
+	} else if *fTestConfig {
 		// Test config
-		conf.Server.Username = "<username>"
-		conf.Server.Password = "**********"
+		for _, srv := range conf.ServerList() {
+			srv.Username = "<username>"
+			srv.Password = "**********"
+		}
 		pp.Println(conf)
 	} else {
 		st, err := mailer.Send(ctx)
@@ -100,10 +121,50 @@ func main() {
 		fmt.Printf("Number Skip         : %d\n", st.NumSkip)
 		fmt.Printf("Number Already Sent : %d\n", st.NumAlreadySent)
 		fmt.Printf("Number Error        : %d\n", st.NumError)
+		fmt.Printf("Number Rejected     : %d\n", st.NumRejected)
+		fmt.Printf("Number Retry        : %d\n", st.NumRetry)
+		fmt.Printf("Number Unsent       : %d\n", st.NumUnsent)
 		fmt.Printf("Total Data          : %d\n", st.Total)
+		variants := []string{}
+		for name := range st.Variants {
+			variants = append(variants, name)
+		}
+		sort.Strings(variants)
+		for _, name := range variants {
+			fmt.Printf("Variant %-12s: %d\n", name, st.Variants[name])
+		}
 		if err != nil {
 			log.Fatalf("Error sending email: %v\n", err)
 		}
 		log.Printf("Sending email done, elapsed: %v\n", time.Since(start))
 	}
 }
+
+// promptCredential asks for username and password if not configured
+func promptCredential(prefix string, srv *sendme.ServerConfig) {
+	if srv.Username == "" {
+		fmt.Print(prefix + "Username: ")
+		scanner := bufio.NewScanner(os.Stdin)
+		if scanner.Scan() {
+			srv.Username = scanner.Text()
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("Error scanning input: %v\n", err)
+		}
+
+		if u := strings.TrimSpace(srv.Username); u == "" {
+			log.Fatalln("Username not specified")
+		}
+	}
+
+	if srv.Password == "" {
+		// scan password
+		fmt.Print(prefix + "Password: ")
+		bytepw, err := term.ReadPassword(int(syscall.Stdin))
+		if err != nil {
+			os.Exit(1)
+		}
+		srv.Password = string(bytepw)
+		fmt.Println()
+	}
+}
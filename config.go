@@ -3,6 +3,7 @@ package sendme
 import (
 	"crypto/tls"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/ipsusila/opt"
@@ -33,8 +34,12 @@ var vmAuthType = map[string]mail.AuthType{
 	"CRAM-MD5": mail.AuthCRAMMD5,
 }
 
-// ServerConfig stores connection configuration
+// ServerConfig stores connection configuration. Priority and weight
+// are used when multiple servers are configured, lower priority is preferred.
 type ServerConfig struct {
+	Name           string `json:"name"`
+	Priority       int    `json:"priority"`
+	Weight         int    `json:"weight"`
 	Authentication string `json:"authentication"`
 	Encryption     string `json:"encryption"`
 	Username       string `json:"username"`
@@ -47,26 +52,104 @@ type ServerConfig struct {
 	KeepAlive      bool   `json:"keepAlive"`
 }
 
+// DataSourceConfig stores database query used to load mail data.
+// Driver must be registered through database/sql, e.g. "sqlite".
+type DataSourceConfig struct {
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+	Query  string `json:"query"`
+	Params []any  `json:"params"`
+}
+
+// XlsxConfig stores worksheet and table selection for xlsx data file.
+// Rows and sheet index are 1-based, zero value means not specified.
+type XlsxConfig struct {
+	Sheet          string `json:"sheet"`
+	SheetIndex     int    `json:"sheetIndex"`
+	HeaderRow      int    `json:"headerRow"`
+	Range          string `json:"range"`
+	StopAtBlankRow bool   `json:"stopAtBlankRow"`
+	RawValue       bool   `json:"rawValue"`
+	Formula        string `json:"formula"`
+}
+
+// ColumnConfig describes type, default value and validation rule of a data column.
+// Column is looked up by Name or Aliases, and renamed to As if given.
+type ColumnConfig struct {
+	Name     string   `json:"name"`
+	Aliases  []string `json:"aliases"`
+	As       string   `json:"as"`
+	Type     string   `json:"type"`
+	Layout   string   `json:"layout"`
+	Default  string   `json:"default"`
+	Required bool     `json:"required"`
+	Pattern  string   `json:"pattern"`
+	Enum     []string `json:"enum"`
+}
+
 // DeliveryConfig stores delivery configuration
 type DeliveryConfig struct {
-	From                  string   `json:"from"`
-	CcList                string   `json:"ccList"`
-	BccList               string   `json:"bccList"`
-	MailFormat            string   `json:"mailFormat"`
-	TemplateFiles         []string `json:"templateFiles"`
-	TemplateName          string   `json:"templateName"`
-	DataFile              string   `json:"dataFile"`
-	ToDataField           string   `json:"toDataField"`
-	SubjectDataField      string   `json:"subjectDataField"`
-	DefaultSubject        string   `json:"defaultSubject"`
-	SkipConfirmBeforeSend bool     `json:"skipConfirmBeforeSend"`
-	TestAddress           string   `json:"testAddress"`
-	SendMode              bool     `json:"sendMode"`
-	SentFile              string   `json:"sentFile"`
-	SkipIfSent            bool     `json:"skipIfSent"`
-	RequiredFields        []string `json:"requiredFields"`
-	IntervalBetweenSend   string   `json:"intervalBetweenSend"`
-	ResendFile            string   `json:"resendFile"`
+	From                  string            `json:"from"`
+	FromName              string            `json:"fromName"`
+	ReplyTo               string            `json:"replyTo"`
+	Headers               map[string]string `json:"headers"`
+	CcList                string            `json:"ccList"`
+	BccList               string            `json:"bccList"`
+	MailFormat            string            `json:"mailFormat"`
+	TemplateFiles         []string          `json:"templateFiles"`
+	TemplateName          string            `json:"templateName"`
+	LayoutFile            string            `json:"layoutFile"`
+	PartialPaths          []string          `json:"partialPaths"`
+	TemplateDataField     string            `json:"templateDataField"`
+	Variants              []*VariantConfig  `json:"variants"`
+	LanguageDataField     string            `json:"languageDataField"`
+	Locales               []string          `json:"locales"`
+	DefaultLocale         string            `json:"defaultLocale"`
+	CatalogFile           string            `json:"catalogFile"`
+	TrackingURL           string            `json:"trackingUrl"`
+	TextTemplateFiles     []string          `json:"textTemplateFiles"`
+	TextTemplateName      string            `json:"textTemplateName"`
+	AutoText              bool              `json:"autoText"`
+	MarkdownLayoutFile    string            `json:"markdownLayoutFile"`
+	Pdf                   []*PdfConfig      `json:"pdf"`
+	InlineCss             bool              `json:"inlineCss"`
+	EmbedImages           bool              `json:"embedImages"`
+	ImageRoot             string            `json:"imageRoot"`
+	Minify                bool              `json:"minify"`
+	DataFile              string            `json:"dataFile"`
+	DataSource            *DataSourceConfig `json:"dataSource"`
+	Xlsx                  *XlsxConfig       `json:"xlsx"`
+	Columns               []*ColumnConfig   `json:"columns"`
+	ToDataField           string            `json:"toDataField"`
+	CcDataField           string            `json:"ccDataField"`
+	BccDataField          string            `json:"bccDataField"`
+	ReplyToDataField      string            `json:"replyToDataField"`
+	FromDataField         string            `json:"fromDataField"`
+	SenderDataField       string            `json:"senderDataField"`
+	AddressPolicy         string            `json:"addressPolicy"`
+	SubjectDataField      string            `json:"subjectDataField"`
+	DefaultSubject        string            `json:"defaultSubject"`
+	SkipConfirmBeforeSend bool              `json:"skipConfirmBeforeSend"`
+	TestAddress           string            `json:"testAddress"`
+	SendMode              bool              `json:"sendMode"`
+	PreviewMode           bool              `json:"previewMode"`
+	PreviewDir            string            `json:"previewDir"`
+	SentFile              string            `json:"sentFile"`
+	JournalFile           string            `json:"journalFile"`
+	KeyDataField          string            `json:"keyDataField"`
+	SkipIfSent            bool              `json:"skipIfSent"`
+	DuplicateCheck        string            `json:"duplicateCheck"`
+	HashParts             []string          `json:"hashParts"`
+	RequiredFields        []string          `json:"requiredFields"`
+	AttachmentRoot        string            `json:"attachmentRoot"`
+	MaxAttachmentSize     string            `json:"maxAttachmentSize"`
+	SkipAttachmentCheck   bool              `json:"skipAttachmentCheck"`
+	PreflightCheck        bool              `json:"preflightCheck"`
+	IntervalBetweenSend   string            `json:"intervalBetweenSend"`
+	RateLimit             *RateLimitConfig  `json:"rateLimit"`
+	Retry                 *RetryConfig      `json:"retry"`
+	Workers               int               `json:"workers"`
+	ResendFile            string            `json:"resendFile"`
 }
 
 // TlsConfig definition
@@ -80,10 +163,31 @@ type TlsConfig struct {
 
 // Config stores configuration for the application
 type Config struct {
-	Server   *ServerConfig   `json:"server"`
-	Delivery *DeliveryConfig `json:"delivery"`
-	Tls      *TlsConfig      `json:"tls"`
-	Verbose  bool            `json:"verbose"`
+	Server    *ServerConfig    `json:"server"`
+	Servers   []*ServerConfig  `json:"servers"`
+	Failover  *FailoverConfig  `json:"failover"`
+	Transport *TransportConfig `json:"transport"`
+	Delivery  *DeliveryConfig  `json:"delivery"`
+	Tls       *TlsConfig       `json:"tls"`
+	Verbose   bool             `json:"verbose"`
+}
+
+// ServerList returns configured servers, single server is used
+// if list of servers is not specified.
+func (c *Config) ServerList() []*ServerConfig {
+	if len(c.Servers) > 0 {
+		return c.Servers
+	}
+	if c.Server != nil {
+		return []*ServerConfig{c.Server}
+	}
+	return nil
+}
+
+// UseSmtp returns true if messages are delivered to SMTP servers
+func (c *Config) UseSmtp() bool {
+	return c.Transport == nil || c.Transport.Type == "" ||
+		strings.EqualFold(c.Transport.Type, TransportSmtp)
 }
 
 // MakeTlsConfig return tls.Config from given configuration
@@ -162,6 +266,8 @@ func DefaultConfig() *Config {
 			DefaultSubject:        "Mail from Golang",
 			TemplateName:          "sendme",
 			SentFile:              "sentaddr.txt",
+			JournalFile:           "journal.jsonl",
+			PreviewDir:            "preview",
 			SkipIfSent:            true,
 			SkipConfirmBeforeSend: true,
 		},
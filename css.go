@@ -0,0 +1,302 @@
+package sendme
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/gorilla/css/scanner"
+	"golang.org/x/net/html"
+)
+
+// dynamic pseudo classes depend on user interaction and are kept in <style>
+var cssDynamicPseudo = map[string]bool{
+	"hover": true, "active": true, "focus": true, "focus-within": true,
+	"focus-visible": true, "visited": true, "target": true,
+}
+
+// cssDecl is a single property declaration
+type cssDecl struct {
+	prop      string
+	value     string
+	important bool
+}
+
+// cssRule is a rule with a single selector which can be inlined
+type cssRule struct {
+	sel   cascadia.Sel
+	order int
+	decls []cssDecl
+}
+
+// cssTokens splits css into tokens, comments are dropped.
+// Strings and url() are single tokens, so braces, commas and
+// semicolons inside them are not structural.
+func cssTokens(src string) []*scanner.Token {
+	var tokens []*scanner.Token
+	s := scanner.New(src)
+	for {
+		tok := s.Next()
+		switch tok.Type {
+		case scanner.TokenEOF, scanner.TokenError:
+			return tokens
+		case scanner.TokenComment:
+			continue
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+// cssText joins tokens back into css
+func cssText(tokens []*scanner.Token) string {
+	var sb strings.Builder
+	for _, tok := range tokens {
+		sb.WriteString(tok.Value)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// isCssChar checks for delimiter token
+func isCssChar(tok *scanner.Token, c string) bool {
+	return tok.Type == scanner.TokenChar && tok.Value == c
+}
+
+// cssSplit splits tokens at top level delimiter, i.e. outside of
+// parentheses, brackets and blocks
+func cssSplit(tokens []*scanner.Token, delim string) [][]*scanner.Token {
+	var parts [][]*scanner.Token
+	depth, start := 0, 0
+	for i, tok := range tokens {
+		switch {
+		case tok.Type == scanner.TokenFunction, isCssChar(tok, "("), isCssChar(tok, "["), isCssChar(tok, "{"):
+			depth++
+		case isCssChar(tok, ")"), isCssChar(tok, "]"), isCssChar(tok, "}"):
+			depth--
+		case depth == 0 && isCssChar(tok, delim):
+			parts = append(parts, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, tokens[start:])
+}
+
+// cssBlockEnd returns index of token closing the block opened at start
+func cssBlockEnd(tokens []*scanner.Token, start int) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		switch {
+		case isCssChar(tokens[i], "{"):
+			depth++
+		case isCssChar(tokens[i], "}"):
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(tokens)
+}
+
+// parseStylesheet splits stylesheet into rules which can be inlined
+// and residual css (at-rules, dynamic pseudo classes, pseudo elements,
+// unsupported selectors) which must stay in <style> element.
+func parseStylesheet(src string, order *int) ([]*cssRule, string) {
+	tokens := cssTokens(src)
+	var rules []*cssRule
+	var residual strings.Builder
+
+	for i := 0; i < len(tokens); {
+		tok := tokens[i]
+		if tok.Type == scanner.TokenS || tok.Type == scanner.TokenCDO || tok.Type == scanner.TokenCDC {
+			i++
+			continue
+		}
+
+		// prelude ends at block or, for statement at-rule, at semicolon
+		start := i
+		for i < len(tokens) && !isCssChar(tokens[i], "{") &&
+			!(tok.Type == scanner.TokenAtKeyword && isCssChar(tokens[i], ";")) {
+			i++
+		}
+		if i >= len(tokens) || isCssChar(tokens[i], ";") {
+			end := i
+			if end < len(tokens) {
+				end++
+			}
+			residual.WriteString(cssText(tokens[start:end]) + "\n")
+			i = end
+			continue
+		}
+		end := cssBlockEnd(tokens, i)
+		prelude, body := tokens[start:i], tokens[i+1:end]
+		if end < len(tokens) {
+			end++
+		}
+		i = end
+
+		if tok.Type == scanner.TokenAtKeyword {
+			// e.g. @media, @font-face
+			residual.WriteString(cssText(tokens[start:end]) + "\n")
+			continue
+		}
+		decls := parseDeclarations(body)
+		if len(decls) == 0 {
+			continue
+		}
+		for _, part := range cssSplit(prelude, ",") {
+			sel := cssText(part)
+			if sel == "" {
+				continue
+			}
+			rule := parseSelector(part)
+			if rule == nil {
+				residual.WriteString(sel + " { " + cssText(body) + " }\n")
+				continue
+			}
+			*order++
+			rule.order = *order
+			rule.decls = decls
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, strings.TrimSpace(residual.String())
+}
+
+// parseDeclarations parses `prop: value [!important]; ...`
+func parseDeclarations(tokens []*scanner.Token) []cssDecl {
+	var decls []cssDecl
+	for _, item := range cssSplit(tokens, ";") {
+		colon := -1
+		for i, tok := range item {
+			if isCssChar(tok, ":") {
+				colon = i
+				break
+			}
+		}
+		if colon < 0 {
+			continue
+		}
+		value := item[colon+1:]
+		d := cssDecl{prop: strings.ToLower(cssText(item[:colon]))}
+		// trailing `! important`
+		n := len(value)
+		for n > 0 && value[n-1].Type == scanner.TokenS {
+			n--
+		}
+		if n > 0 && value[n-1].Type == scanner.TokenIdent && strings.EqualFold(value[n-1].Value, "important") {
+			k := n - 1
+			for k > 0 && value[k-1].Type == scanner.TokenS {
+				k--
+			}
+			if k > 0 && isCssChar(value[k-1], "!") {
+				d.important = true
+				n = k - 1
+			}
+		}
+		d.value = cssText(value[:n])
+		if d.prop != "" && d.value != "" {
+			decls = append(decls, d)
+		}
+	}
+	return decls
+}
+
+// parseSelector returns nil for selector which can not be inlined
+func parseSelector(tokens []*scanner.Token) *cssRule {
+	for i, tok := range tokens {
+		if isCssChar(tok, ":") && i+1 < len(tokens) && tokens[i+1].Type == scanner.TokenIdent &&
+			cssDynamicPseudo[strings.ToLower(tokens[i+1].Value)] {
+			return nil
+		}
+	}
+	// pseudo elements and unknown selectors are rejected by parser
+	sel, err := cascadia.Parse(cssText(tokens))
+	if err != nil {
+		return nil
+	}
+	return &cssRule{sel: sel}
+}
+
+func (r *cssRule) less(o *cssRule) bool {
+	if rs, ps := r.sel.Specificity(), o.sel.Specificity(); rs != ps {
+		return rs.Less(ps)
+	}
+	return r.order < o.order
+}
+
+// inlineStyles applies rules to style attribute of matching elements.
+// Declarations are applied by specificity and order, inline style wins
+// over non-important rules.
+func inlineStyles(root *html.Node, rules []*cssRule) {
+	if len(rules) == 0 {
+		return
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].less(rules[j])
+	})
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			applyRules(n, rules)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+}
+
+func applyRules(n *html.Node, rules []*cssRule) {
+	var matched []*cssRule
+	for _, r := range rules {
+		if r.sel.Match(n) {
+			matched = append(matched, r)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	var props []string
+	values := map[string]string{}
+	set := func(d cssDecl) {
+		if _, ok := values[d.prop]; !ok {
+			props = append(props, d.prop)
+		}
+		values[d.prop] = d.value
+	}
+
+	inline := parseDeclarations(cssTokens(attr(n, "style")))
+	for _, important := range []bool{false, true} {
+		for _, r := range matched {
+			for _, d := range r.decls {
+				if d.important == important {
+					set(d)
+				}
+			}
+		}
+		for _, d := range inline {
+			if d.important == important {
+				set(d)
+			}
+		}
+	}
+
+	items := make([]string, len(props))
+	for i, prop := range props {
+		items[i] = prop + ": " + values[prop]
+	}
+	setAttr(n, "style", strings.Join(items, "; "))
+}
+
+func setAttr(n *html.Node, key, val string) {
+	for i := range n.Attr {
+		if n.Attr[i].Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
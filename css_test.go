@@ -0,0 +1,68 @@
+package sendme_test
+
+import (
+	"testing"
+
+	"github.com/ipsusila/sendme"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInlineCss(t *testing.T) {
+	conf := sendConfig(t, "Name,Email\nAlice,alice@example.com\n", `<html><head><style>
+/* rules below contain } and ; */
+.quote { font-family: "Brace } Sans; Serif", serif; color: red }
+.bg { background: url(data:image/png;base64,AAAA) no-repeat; padding: 1px }
+.bg2 { background: url("img/a;b.png") }
+a[href^="https://"] { color: green }
+td[title="a,b"], td.total { font-weight: bold }
+p { color: black }
+#intro { color: navy }
+.note { color: gray !important }
+a:hover, a:focus { color: blue }
+p::first-line { font-size: 20px }
+@import url("print.css");
+@media (max-width: 600px) { p { margin: 4px } }
+</style></head>
+<body>
+<p class="quote">Quote</p>
+<div class="bg">Bg</div><div class="bg2">Bg2</div>
+<a href="https://example.com">secure</a> <a href="http://example.com">plain</a>
+<table><tr><td title="a,b">x</td><td class="total">y</td><td>z</td></tr></table>
+<p id="intro" style="color: maroon">Intro</p>
+<p id="intro2" class="note" style="color: maroon">Note</p>
+</body></html>`)
+	d := conf.Delivery
+	d.MailFormat = sendme.HtmlFormat
+	d.InlineCss = true
+
+	tr := recordTransport{}
+	_, err := tr.send(t, conf)
+	if !assert.NoError(t, err) || !assert.Len(t, tr.messages, 1) {
+		return
+	}
+	html := tr.messages[0].Html
+
+	// braces and semicolons inside strings and url() are part of the value
+	assert.Contains(t, html, `<p class="quote" style="color: red; font-family: &#34;Brace } Sans; Serif&#34;, serif">`)
+	assert.Contains(t, html, `<div class="bg" style="background: url(data:image/png;base64,AAAA) no-repeat; padding: 1px">`)
+	assert.Contains(t, html, `<div class="bg2" style="background: url(&#34;img/a;b.png&#34;)">`)
+
+	// attribute selectors, comma inside attribute value
+	assert.Contains(t, html, `<a href="https://example.com" style="color: green">`)
+	assert.Contains(t, html, `<a href="http://example.com">`)
+	assert.Contains(t, html, `<td title="a,b" style="font-weight: bold">`)
+	assert.Contains(t, html, `<td class="total" style="font-weight: bold">`)
+	assert.Contains(t, html, `<td>z</td>`)
+
+	// inline style wins over rules, important rule wins over inline style
+	assert.Contains(t, html, `<p id="intro" style="color: maroon">`)
+	assert.Contains(t, html, `<p id="intro2" class="note" style="color: gray">`)
+
+	// dynamic pseudo classes, pseudo elements and at-rules stay in <style>
+	assert.Contains(t, html, `a:hover { color: blue }`)
+	assert.Contains(t, html, `a:focus { color: blue }`)
+	assert.Contains(t, html, `p::first-line { font-size: 20px }`)
+	assert.Contains(t, html, `@import url("print.css");`)
+	assert.Contains(t, html, `@media (max-width: 600px) { p { margin: 4px } }`)
+	assert.NotContains(t, html, "rules below")
+}
@@ -1,16 +1,13 @@
 package sendme
 
 import (
-	"encoding/csv"
 	"errors"
 	"fmt"
+	"io"
 	"net/mail"
-	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-
-	"github.com/xuri/excelize/v2"
 )
 
 // Attachment key.
@@ -27,9 +24,12 @@ type MailDataCollection struct {
 }
 
 type AttachmentFile struct {
+	Key      string
 	FilePath string
 	Name     string
 	Inline   bool
+	// Data is content of generated file, used instead of FilePath
+	Data []byte
 }
 
 type Stats struct {
@@ -39,6 +39,30 @@ type Stats struct {
 	NumAlreadySent int
 	NumSkip        int
 	NumError       int
+	// retried attempts and messages rejected permanently (included in NumError)
+	NumRetry    int
+	NumRejected int
+	// messages not sent because the run was stopped
+	NumUnsent int
+	// number of sent data per template/variant
+	Variants map[string]int
+}
+
+// sent counts sent data of n addresses
+func (s *Stats) sent(n int, variant string) {
+	s.NumSentAddr += n
+	s.NumSentData++
+	s.countVariant(variant)
+}
+
+func (s *Stats) countVariant(variant string) {
+	if variant == "" {
+		return
+	}
+	if s.Variants == nil {
+		s.Variants = map[string]int{}
+	}
+	s.Variants[variant]++
 }
 
 // StringDefault return string value or default
@@ -48,6 +72,8 @@ func (m MailData) StringDefault(key, def string) string {
 		return def
 	}
 	switch vv := v.(type) {
+	case nil:
+		return def
 	case string:
 		return vv
 	case *string:
@@ -62,12 +88,18 @@ func (m MailData) StringDefault(key, def string) string {
 	}
 }
 func (m MailData) HasFields(reqFields []string) bool {
+	return len(m.MissingFields(reqFields)) == 0
+}
+
+// MissingFields return required fields which are empty
+func (m MailData) MissingFields(reqFields []string) []string {
+	var missing []string
 	for _, field := range reqFields {
 		if val := m.StringDefault(field, ""); val == "" {
-			return false
+			missing = append(missing, field)
 		}
 	}
-	return true
+	return missing
 }
 
 // AttachmentFiles extract attachment file.
@@ -78,7 +110,7 @@ func (m MailData) AttachmentFiles() []*AttachmentFile {
 		lk := strings.ToLower(key)
 		if field, ok := val.(string); ok && strings.HasPrefix(lk, AttachmentKeyPrefix) {
 			items := strings.Split(field, ",")
-			af := AttachmentFile{}
+			af := AttachmentFile{Key: key}
 			for i, item := range items {
 				val := strings.TrimSpace(item)
 				switch i {
@@ -95,6 +127,9 @@ func (m MailData) AttachmentFiles() []*AttachmentFile {
 			}
 		}
 	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Key < files[j].Key
+	})
 	return files
 }
 
@@ -129,114 +164,51 @@ func ParseAddressList(list string) ([]*mail.Address, error) {
 	return addresses, err
 }
 
-// NewMailDataCollection create mail data collection from files
-func NewMailDataCollection(conf *Config) (*MailDataCollection, error) {
-	mc := MailDataCollection{}
-	if conf == nil || conf.Delivery == nil || conf.Delivery.DataFile == "" {
-		// silently return default data
-		return &mc, nil
+// AddressField parse address list stored in field.
+// Empty list is returned if field is not specified or empty.
+func (m MailData) AddressField(field string) ([]*mail.Address, error) {
+	if field == "" {
+		return nil, nil
 	}
-	if err := mc.load(conf.Delivery.DataFile); err != nil {
-		return nil, err
-	}
-
-	return &mc, nil
-}
-
-func (m *MailDataCollection) load(filename string) error {
-	ext := strings.ToLower(filepath.Ext(filename))
-	switch ext {
-	case ".xlsx":
-		return m.loadXlsx(filename)
-	case ".csv":
-		return m.loadCsv(filename)
+	vals := strings.TrimSpace(m.StringDefault(field, ""))
+	if vals == "" {
+		return nil, nil
 	}
-
-	return fmt.Errorf("unknown file type: %s", filename)
-}
-func (m *MailDataCollection) loadXlsx(filename string) error {
-	f, err := excelize.OpenFile(filename)
+	list, err := ParseAddressList(vals)
 	if err != nil {
-		return fmt.Errorf("open xlsx file %s error: %w", filename, err)
-	}
-	defer f.Close()
-
-	// Get first non empty row
-	sheet := "Sheet1"
-	if idx := f.GetActiveSheetIndex(); idx > 0 {
-		sheet = f.GetSheetName(idx)
-	} else {
-		sheets := f.GetSheetList()
-		for _, name := range sheets {
-			sheet = name
-			break
-		}
+		return nil, fmt.Errorf("parse address `%s` in field `%s` error: %w", vals, field, err)
 	}
-
-	rows, err := f.GetRows(sheet)
-	if err != nil {
-		return fmt.Errorf("method GetRows error: %w", err)
-	}
-	return m.rowsToCollection(rows)
+	return list, nil
 }
-func (m *MailDataCollection) loadCsv(filename string) error {
-	f, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("open csv file %s error: %w", filename, err)
-	}
-	defer f.Close()
 
-	rd := csv.NewReader(f)
-	rd.FieldsPerRecord = -1
-	rd.TrimLeadingSpace = true
-	rows, err := rd.ReadAll()
+// NewMailDataCollection create mail data collection from files.
+// All rows are loaded into memory, use OpenRowSource to iterate rows lazily.
+func NewMailDataCollection(conf *Config) (*MailDataCollection, error) {
+	src, err := OpenRowSource(conf)
 	if err != nil {
-		return fmt.Errorf("read all csv rows error: %w", err)
-	}
-	return m.rowsToCollection(rows)
-}
-
-func (m *MailDataCollection) rowsToCollection(rows [][]string) error {
-	firstRow := -1
-	firstCol := -1
-	var tags []string
-	for r, row := range rows {
-		for c, col := range row {
-			if col != "" {
-				tags = row[c:]
-				firstRow = r + 1
-				firstCol = c
-				break
-			}
-		}
-		if tags != nil {
-			for i, tag := range tags {
-				tags[i] = strings.TrimSpace(tag)
-			}
-			break
-		}
+		return nil, err
 	}
+	defer src.Close()
 
-	if firstRow < 0 || firstCol < 0 {
-		return errors.New("non-empty row/col not found")
+	mc := MailDataCollection{}
+	if n := src.Total(); n > 0 {
+		mc.Data = make([]MailData, 0, n)
 	}
-
-	ntags := len(tags)
-	for r := firstRow; r < len(rows); r++ {
-		row := rows[r]
-		ncol := len(row)
-		if ntags < ncol {
-			ncol = ntags
+	for {
+		md, err := src.Next()
+		if errors.Is(err, io.EOF) {
+			break
 		}
-
-		md := make(MailData)
-		for c := firstCol; c < ncol; c++ {
-			key := tags[c-firstCol]
-			val := strings.TrimSpace(row[c])
-			md[key] = val
+		if err != nil {
+			return nil, err
 		}
-		m.Data = append(m.Data, md)
+		mc.Data = append(mc.Data, md)
 	}
 
-	return nil
+	return &mc, nil
+}
+
+// Rows returns row source iterating the collection
+func (m *MailDataCollection) Rows() RowSource {
+	return &sliceSource{data: m.Data}
 }
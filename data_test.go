@@ -1,11 +1,18 @@
 package sendme_test
 
 import (
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/ipsusila/sendme"
 	"github.com/k0kubun/pp/v3"
 	"github.com/stretchr/testify/assert"
+	"github.com/xuri/excelize/v2"
+	_ "modernc.org/sqlite"
 )
 
 func TestLoadData(t *testing.T) {
@@ -21,6 +28,194 @@ func TestLoadData(t *testing.T) {
 
 }
 
+func TestLoadSql(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "crm.db")
+	db, err := sql.Open("sqlite", dsn)
+	assert.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE customer(name TEXT, email TEXT, score INTEGER, balance REAL, note TEXT);
+		INSERT INTO customer VALUES('Alice', 'alice@example.com', 10, 12.5, NULL);
+		INSERT INTO customer VALUES('Bob', 'bob@example.com', 7, 3.25, 'vip');
+		INSERT INTO customer VALUES('Carol', 'carol@example.com', 2, 0, NULL);`)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	conf := sendme.Config{
+		Delivery: &sendme.DeliveryConfig{
+			DataSource: &sendme.DataSourceConfig{
+				Driver: "sqlite",
+				DSN:    dsn,
+				Query:  "SELECT name AS Name, email AS Email, score, balance, note FROM customer WHERE score > ? ORDER BY name",
+				Params: []any{5},
+			},
+		},
+	}
+	mc, err := sendme.NewMailDataCollection(&conf)
+	assert.NoError(t, err)
+	if assert.Len(t, mc.Data, 2) {
+		assert.Equal(t, "Alice", mc.Data[0]["Name"])
+		assert.Equal(t, "bob@example.com", mc.Data[1]["Email"])
+		assert.Equal(t, int64(10), mc.Data[0]["score"])
+		assert.Equal(t, 3.25, mc.Data[1]["balance"])
+		assert.Nil(t, mc.Data[0]["note"])
+		assert.Equal(t, "", mc.Data[0].StringDefault("note", ""))
+	}
+}
+
+func TestLoadStructured(t *testing.T) {
+	files := map[string]string{
+		"list.json": `[
+			{"Name": "Alice", "Email": "alice@example.com", "Amount": 1500000, "Company": {"Name": "ACME", "City": "Bandung"}},
+			{"Name": "Bob", "Email": "bob@example.com", "Amount": 12.5, "Company": {"Name": "Initech", "City": "Jakarta"}}
+		]`,
+		"list.jsonl": `{"Name": "Alice", "Email": "alice@example.com", "Amount": 1500000, "Company": {"Name": "ACME", "City": "Bandung"}}
+
+{"Name": "Bob", "Email": "bob@example.com", "Amount": 12.5, "Company": {"Name": "Initech", "City": "Jakarta"}}
+`,
+		"list.yaml": `
+- Name: Alice
+  Email: alice@example.com
+  Amount: 1500000
+  Company:
+    Name: ACME
+    City: Bandung
+- Name: Bob
+  Email: bob@example.com
+  Amount: 12.5
+  Company: {Name: Initech, City: Jakarta}
+`,
+	}
+
+	dir := t.TempDir()
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(filename, []byte(content), 0644))
+
+		conf := sendme.Config{
+			Delivery: &sendme.DeliveryConfig{
+				DataFile: filename,
+			},
+		}
+		mc, err := sendme.NewMailDataCollection(&conf)
+		if !assert.NoError(t, err, name) || !assert.Len(t, mc.Data, 2, name) {
+			continue
+		}
+		assert.Equal(t, "bob@example.com", mc.Data[1]["Email"], name)
+		assert.Equal(t, "1500000", mc.Data[0].StringDefault("Amount", ""), name)
+		company, ok := mc.Data[1]["Company"].(map[string]any)
+		if assert.True(t, ok, name) {
+			assert.Equal(t, "Jakarta", company["City"], name)
+		}
+	}
+}
+
+func TestLoadXlsxOptions(t *testing.T) {
+	f := excelize.NewFile()
+	f.SetCellValue("Sheet1", "A1", "Cover page")
+	f.NewSheet("Data")
+	f.SetCellValue("Data", "A1", "Note: generated by CRM")
+	f.SetSheetRow("Data", "B4", &[]any{"Name", "Email", "Amount", "Double"})
+	f.SetSheetRow("Data", "B5", &[]any{"Alice", "alice@example.com", 1500.5})
+	f.SetSheetRow("Data", "B6", &[]any{"Bob", "bob@example.com", 20})
+	f.SetCellFormula("Data", "E5", "D5*2")
+	f.SetCellFormula("Data", "E6", "D6*2")
+	f.SetSheetRow("Data", "B8", &[]any{"Total", "", 1520.5})
+	style, err := f.NewStyle(&excelize.Style{NumFmt: 4})
+	assert.NoError(t, err)
+	f.SetCellStyle("Data", "D5", "D6", style)
+	filename := filepath.Join(t.TempDir(), "list.xlsx")
+	assert.NoError(t, f.SaveAs(filename))
+
+	conf := sendme.Config{
+		Delivery: &sendme.DeliveryConfig{
+			DataFile: filename,
+			Xlsx: &sendme.XlsxConfig{
+				Sheet:          "Data",
+				HeaderRow:      4,
+				Range:          "B4:E200",
+				StopAtBlankRow: true,
+				Formula:        sendme.FormulaCalculate,
+			},
+		},
+	}
+	mc, err := sendme.NewMailDataCollection(&conf)
+	assert.NoError(t, err)
+	if assert.Len(t, mc.Data, 2) {
+		assert.Equal(t, "alice@example.com", mc.Data[0]["Email"])
+		assert.Equal(t, "1500.50", mc.Data[0]["Amount"])
+		assert.Equal(t, "3001", mc.Data[0]["Double"])
+		assert.Equal(t, "40", mc.Data[1]["Double"])
+	}
+
+	// sheet by index, raw value and range including totals
+	conf.Delivery.Xlsx = &sendme.XlsxConfig{
+		SheetIndex: 2,
+		Range:      "B4:D8",
+		RawValue:   true,
+	}
+	mc, err = sendme.NewMailDataCollection(&conf)
+	assert.NoError(t, err)
+	if assert.Len(t, mc.Data, 4) {
+		assert.Equal(t, "1500.5", mc.Data[0]["Amount"])
+		assert.Equal(t, "Total", mc.Data[3]["Name"])
+		_, ok := mc.Data[0]["Double"]
+		assert.False(t, ok)
+	}
+
+	// header row above the range, notes and blank row are not data
+	f = excelize.NewFile()
+	f.SetSheetRow("Sheet1", "A2", &[]any{"Name", "Email"})
+	f.SetCellValue("Sheet1", "A3", "Note: do not send")
+	f.SetSheetRow("Sheet1", "A5", &[]any{"Alice", "alice@example.com"})
+	f.SetSheetRow("Sheet1", "A6", &[]any{"Bob", "bob@example.com"})
+	f.SetSheetRow("Sheet1", "A11", &[]any{"Carol", "carol@example.com"})
+	assert.NoError(t, f.SaveAs(filename))
+	conf.Delivery.Xlsx = &sendme.XlsxConfig{
+		HeaderRow:      2,
+		Range:          "A5:B10",
+		StopAtBlankRow: true,
+	}
+	mc, err = sendme.NewMailDataCollection(&conf)
+	assert.NoError(t, err)
+	if assert.Len(t, mc.Data, 2) {
+		assert.Equal(t, "Alice", mc.Data[0]["Name"])
+		assert.Equal(t, "bob@example.com", mc.Data[1]["Email"])
+	}
+
+	conf.Delivery.Xlsx = &sendme.XlsxConfig{Sheet: "Missing"}
+	_, err = sendme.NewMailDataCollection(&conf)
+	assert.Error(t, err)
+}
+
+func TestRowSource(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "list.csv")
+	content := "\n,Name,Email\n,Alice,alice@example.com\n,Bob,bob@example.com\n"
+	assert.NoError(t, os.WriteFile(filename, []byte(content), 0644))
+
+	conf := sendme.Config{
+		Delivery: &sendme.DeliveryConfig{
+			DataFile: filename,
+		},
+	}
+	src, err := sendme.OpenRowSource(&conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer src.Close()
+	assert.Equal(t, -1, src.Total())
+
+	var emails []string
+	for {
+		md, err := src.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.NoError(t, err)
+		emails = append(emails, md.StringDefault("Email", ""))
+	}
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com"}, emails)
+}
+
 func TestParseAddress(t *testing.T) {
 	list := []string{
 		"me@example.com",
@@ -35,3 +230,24 @@ func TestParseAddress(t *testing.T) {
 		pp.Println(addresses)
 	}
 }
+
+func TestAddressField(t *testing.T) {
+	md := sendme.MailData{
+		"Manager": "Account Manager <am@example.com>; boss@example.com",
+		"Empty":   "",
+		"Invalid": "not an address",
+	}
+	list, err := md.AddressField("Manager")
+	assert.NoError(t, err)
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, "am@example.com", list[0].Address)
+		assert.Equal(t, "Account Manager", list[0].Name)
+	}
+
+	list, err = md.AddressField("Empty")
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+
+	_, err = md.AddressField("Invalid")
+	assert.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package sendme
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+)
+
+// sqlSource maps each row of data source query to MailData.
+// Column names are used as keys, values keep type returned by the driver.
+type sqlSource struct {
+	db   *sql.DB
+	rows *sql.Rows
+	cols []string
+	vals []any
+	ptrs []any
+}
+
+func openSqlSource(ds *DataSourceConfig) (RowSource, error) {
+	db, err := sql.Open(ds.Driver, ds.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("open database %s error: %w", ds.Driver, err)
+	}
+
+	rows, err := db.Query(ds.Query, ds.Params...)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("query `%s` error: %w", ds.Query, err)
+	}
+
+	cols, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		db.Close()
+		return nil, fmt.Errorf("get query columns error: %w", err)
+	}
+
+	s := sqlSource{
+		db:   db,
+		rows: rows,
+		cols: cols,
+		vals: make([]any, len(cols)),
+		ptrs: make([]any, len(cols)),
+	}
+	for i := range s.vals {
+		s.ptrs[i] = &s.vals[i]
+	}
+	return &s, nil
+}
+
+func (s *sqlSource) Next() (MailData, error) {
+	if !s.rows.Next() {
+		if err := s.rows.Err(); err != nil {
+			return nil, fmt.Errorf("iterate rows error: %w", err)
+		}
+		return nil, io.EOF
+	}
+	if err := s.rows.Scan(s.ptrs...); err != nil {
+		return nil, fmt.Errorf("scan row error: %w", err)
+	}
+	md := make(MailData, len(s.cols))
+	for i, col := range s.cols {
+		md[col] = sqlValue(s.vals[i])
+	}
+	return md, nil
+}
+func (s *sqlSource) Total() int {
+	return -1
+}
+func (s *sqlSource) Close() error {
+	s.rows.Close()
+	return s.db.Close()
+}
+
+// sqlValue converts raw bytes returned by driver (e.g. TEXT in some drivers)
+// to string, other values are returned as is.
+func sqlValue(v any) any {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
@@ -0,0 +1,167 @@
+package sendme
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// ErrNoServer is returned when circuit of every SMTP server is open
+var ErrNoServer = errors.New("no smtp server available")
+
+// FailoverConfig opens circuit of server after consecutive failures,
+// server is not used until cool down elapsed.
+type FailoverConfig struct {
+	MaxFailures int    `json:"maxFailures"`
+	CoolDown    string `json:"coolDown"`
+}
+
+// smtpServer is a configured server with its health
+type smtpServer struct {
+	name      string
+	priority  int
+	weight    int
+	server    *mail.SMTPServer
+	failures  int
+	openUntil time.Time
+}
+
+// serverSet selects server by priority and weight. It is safe for concurrent use.
+type serverSet struct {
+	mu          sync.Mutex
+	servers     []*smtpServer
+	maxFailures int
+	coolDown    time.Duration
+}
+
+func newServerSet(conf *Config, tlsConfig *tls.Config) (*serverSet, error) {
+	s := serverSet{maxFailures: 3, coolDown: 5 * time.Minute}
+	if fc := conf.Failover; fc != nil {
+		if fc.MaxFailures > 0 {
+			s.maxFailures = fc.MaxFailures
+		}
+		if fc.CoolDown != "" {
+			d, err := time.ParseDuration(fc.CoolDown)
+			if err != nil {
+				return nil, fmt.Errorf("parsing cool down `%s` error: %w", fc.CoolDown, err)
+			}
+			s.coolDown = d
+		}
+	}
+
+	for _, sc := range conf.ServerList() {
+		srv := mail.NewSMTPClient()
+		if err := sc.Configure(srv); err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = tlsConfig
+		name := sc.Name
+		if name == "" {
+			name = sc.Host + ":" + strconv.Itoa(sc.Port)
+		}
+		weight := sc.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		s.servers = append(s.servers, &smtpServer{
+			name:     name,
+			priority: sc.Priority,
+			weight:   weight,
+			server:   srv,
+		})
+	}
+	if len(s.servers) == 0 {
+		return nil, errors.New("server configuration not specified")
+	}
+	sort.SliceStable(s.servers, func(i, j int) bool {
+		return s.servers[i].priority < s.servers[j].priority
+	})
+	return &s, nil
+}
+
+// candidates returns servers with closed circuit in order of preference.
+// Servers of the same priority are ordered randomly by weight.
+func (s *serverSet) candidates() []*smtpServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var list, group []*smtpServer
+	total := 0
+	flush := func() {
+		for len(group) > 0 {
+			n := rand.Intn(total)
+			for i, srv := range group {
+				if n -= srv.weight; n < 0 {
+					list = append(list, srv)
+					total -= srv.weight
+					group = append(group[:i], group[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	for i, srv := range s.servers {
+		if i > 0 && srv.priority != s.servers[i-1].priority {
+			flush()
+		}
+		if srv.openUntil.After(now) {
+			continue
+		}
+		group = append(group, srv)
+		total += srv.weight
+	}
+	flush()
+	return list
+}
+
+// preferred returns true if server of lower priority than srv is available
+func (s *serverSet) preferred(srv *smtpServer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, other := range s.servers {
+		if other.priority >= srv.priority {
+			break
+		}
+		if !other.openUntil.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// success closes circuit of server
+func (s *serverSet) success(srv *smtpServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv.failures = 0
+	srv.openUntil = time.Time{}
+}
+
+// failure counts failure of server, circuit is opened after max
+// consecutive failures or immediately when authentication is rejected.
+// Returns true if circuit is opened.
+func (s *serverSet) failure(srv *smtpServer, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv.failures++
+	var tpe *textproto.Error
+	if errors.As(err, &tpe) && tpe.Code >= 500 {
+		srv.failures = s.maxFailures
+	}
+	if srv.failures < s.maxFailures {
+		return false
+	}
+	srv.failures = 0
+	srv.openUntil = time.Now().Add(s.coolDown)
+	return true
+}
@@ -0,0 +1,246 @@
+package sendme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/qr"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+var rupiahPrinter = message.NewPrinter(language.Indonesian)
+
+// rowState collects attachments added by template functions for a row
+type rowState struct {
+	key   string
+	files []*AttachmentFile
+	// number of generated images, used for unique names
+	images int
+}
+
+// mailFuncs provides built-in mail helper functions of templates.
+// Functions with side effects (qrcode, barcode, attachFile) only work
+// while the row is rendered by Mailer.
+type mailFuncs struct {
+	attach   *attachmentResolver
+	tracking string
+	lookups  map[string]map[string]MailData
+	state    *rowState
+}
+
+func newMailFuncs(d *DeliveryConfig) (*mailFuncs, error) {
+	attach, err := newAttachmentResolver(d)
+	if err != nil {
+		return nil, err
+	}
+	return &mailFuncs{
+		attach:   attach,
+		tracking: d.TrackingURL,
+		lookups:  make(map[string]map[string]MailData),
+	}, nil
+}
+
+// begin starts rendering of a row identified by key
+func (f *mailFuncs) begin(key string) {
+	f.state = &rowState{key: key}
+}
+
+// end finishes rendering and returns attachments added by functions
+func (f *mailFuncs) end() []*AttachmentFile {
+	if f.state == nil {
+		return nil
+	}
+	files := f.state.files
+	f.state = nil
+	return files
+}
+
+// image returns data of generated image and removes it from attachments,
+// used when the image is embedded in a generated document instead
+func (f *mailFuncs) image(name string) []byte {
+	if f.state == nil {
+		return nil
+	}
+	for i, af := range f.state.files {
+		if af.Inline && af.Name == name && af.Data != nil {
+			f.state.files = append(f.state.files[:i], f.state.files[i+1:]...)
+			return af.Data
+		}
+	}
+	return nil
+}
+
+func (f *mailFuncs) funcMap() map[string]any {
+	return map[string]any{
+		"qrcode":       f.qrcode,
+		"barcode":      f.barcode,
+		"trackingURL":  f.trackingURL,
+		"formatRupiah": formatRupiah,
+		"attachFile":   f.attachFile,
+		"lookup":       f.lookup,
+	}
+}
+
+// qrcode embeds QR code image of content, returns cid: URL for <img src>
+func (f *mailFuncs) qrcode(content string, size ...int) (htmltemplate.URL, error) {
+	code, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return "", fmt.Errorf("qrcode: %w", err)
+	}
+	width := 200
+	if len(size) > 0 {
+		width = size[0]
+	}
+	return f.embedCode("qrcode", code, width, width)
+}
+
+// barcode embeds Code 128 barcode image of content (optional width and height)
+func (f *mailFuncs) barcode(content string, size ...int) (htmltemplate.URL, error) {
+	code, err := code128.Encode(content)
+	if err != nil {
+		return "", fmt.Errorf("barcode: %w", err)
+	}
+	width, height := 300, 80
+	if len(size) > 0 {
+		width = size[0]
+	}
+	if len(size) > 1 {
+		height = size[1]
+	}
+	return f.embedCode("barcode", code, width, height)
+}
+
+func (f *mailFuncs) embedCode(kind string, code barcode.Barcode, width, height int) (htmltemplate.URL, error) {
+	if f.state == nil {
+		return "", fmt.Errorf("%s: only available when rendering mail", kind)
+	}
+	scaled, err := barcode.Scale(code, width, height)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", kind, err)
+	}
+	// 8-bit image, 16-bit PNG is not supported in PDF
+	gray := image.NewGray(scaled.Bounds())
+	draw.Draw(gray, gray.Bounds(), scaled, scaled.Bounds().Min, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, gray); err != nil {
+		return "", fmt.Errorf("%s: encode png error: %w", kind, err)
+	}
+
+	f.state.images++
+	name := fmt.Sprintf("%s-%d.png", kind, f.state.images)
+	f.state.files = append(f.state.files, &AttachmentFile{
+		Key:    kind,
+		Name:   name,
+		Data:   buf.Bytes(),
+		Inline: true,
+	})
+	return htmltemplate.URL("cid:" + name), nil
+}
+
+// trackingURL returns link through tracking URL with target and recipient
+// key as query parameters. Target is returned as is if not configured.
+func (f *mailFuncs) trackingURL(target string) (string, error) {
+	if f.tracking == "" {
+		return target, nil
+	}
+	u, err := url.Parse(f.tracking)
+	if err != nil {
+		return "", fmt.Errorf("trackingURL: %w", err)
+	}
+	q := u.Query()
+	q.Set("url", target)
+	if f.state != nil && f.state.key != "" {
+		q.Set("rcpt", f.state.key)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// attachFile attaches file (relative to attachment root, glob or directory)
+// to the message, optionally with different name. Returns empty string.
+func (f *mailFuncs) attachFile(path string, name ...string) (string, error) {
+	if f.state == nil {
+		return "", errors.New("attachFile: only available when rendering mail")
+	}
+	if f.attach.root != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(f.attach.root, path)
+	}
+	matches, err := f.attach.match(path)
+	if err != nil {
+		return "", fmt.Errorf("attachFile %s: %w", path, err)
+	}
+	for _, match := range matches {
+		if err := f.attach.check(match); err != nil {
+			return "", fmt.Errorf("attachFile %s: %w", match, err)
+		}
+		af := AttachmentFile{Key: "attachFile", FilePath: match}
+		if len(matches) == 1 && len(name) > 0 {
+			af.Name = name[0]
+		}
+		f.state.files = append(f.state.files, &af)
+	}
+	return "", nil
+}
+
+// lookup returns row of data file (csv, xlsx, json, yaml) whose column
+// equals key, nil if not found. File is read once.
+func (f *mailFuncs) lookup(filename, column string, key any) (MailData, error) {
+	id := filename + "\x00" + column
+	index, ok := f.lookups[id]
+	if !ok {
+		src, err := openDataFile(filename, nil)
+		if err != nil {
+			return nil, fmt.Errorf("lookup: %w", err)
+		}
+		defer src.Close()
+
+		index = make(map[string]MailData)
+		for {
+			row, err := src.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("lookup %s error: %w", filename, err)
+			}
+			k := strings.TrimSpace(valueString(row[column]))
+			if _, dup := index[k]; !dup {
+				index[k] = row
+			}
+		}
+		f.lookups[id] = index
+	}
+	return index[strings.TrimSpace(valueString(key))], nil
+}
+
+// formatRupiah formats amount as Indonesian Rupiah, e.g. Rp 1.500.000
+func formatRupiah(v any, decimals ...int) (string, error) {
+	f, err := toFloat(v)
+	if err != nil {
+		return "", fmt.Errorf("formatRupiah: %w", err)
+	}
+	n := 0
+	if len(decimals) > 0 {
+		n = decimals[0]
+	}
+	amount := rupiahPrinter.Sprint(number.Decimal(f,
+		number.MinFractionDigits(n),
+		number.MaxFractionDigits(n)))
+	if strings.HasPrefix(amount, "-") {
+		return "-Rp " + amount[1:], nil
+	}
+	return "Rp " + amount, nil
+}
@@ -0,0 +1,110 @@
+package sendme
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Message parts used to compute content hash
+const (
+	HashRecipient  = "recipient"
+	HashSubject    = "subject"
+	HashBody       = "body"
+	HashAttachment = "attachment"
+)
+
+// Duplicate check method
+const (
+	DuplicateByAddress = "ADDRESS"
+	DuplicateByHash    = "HASH"
+)
+
+// HashInput stores message content to be hashed
+type HashInput struct {
+	Recipients []string
+	Subject    string
+	Body       string
+	Files      []*AttachmentFile
+}
+
+// hashesRecipient checks whether recipient is part of the hash
+func hashesRecipient(parts []string) bool {
+	for _, part := range parts {
+		if strings.EqualFold(strings.TrimSpace(part), HashRecipient) {
+			return true
+		}
+	}
+	return len(parts) == 0
+}
+
+// MessageHash computes stable hash (hex sha256) of selected message parts.
+// Recipients and attachments are sorted, so the order does not matter.
+// All parts are used if parts is empty.
+func MessageHash(parts []string, in *HashInput) (string, error) {
+	use := map[string]bool{}
+	for _, part := range parts {
+		part = strings.ToLower(strings.TrimSpace(part))
+		switch part {
+		case HashRecipient, HashSubject, HashBody, HashAttachment:
+			use[part] = true
+		default:
+			return "", fmt.Errorf("unknown hash part: %s", part)
+		}
+	}
+	all := len(use) == 0
+
+	h := sha256.New()
+	if all || use[HashRecipient] {
+		rcpts := make([]string, len(in.Recipients))
+		for i, rcpt := range in.Recipients {
+			rcpts[i] = strings.ToLower(strings.TrimSpace(rcpt))
+		}
+		sort.Strings(rcpts)
+		fmt.Fprintf(h, "%s:%q\n", HashRecipient, rcpts)
+	}
+	if all || use[HashSubject] {
+		fmt.Fprintf(h, "%s:%q\n", HashSubject, in.Subject)
+	}
+	if all || use[HashBody] {
+		fmt.Fprintf(h, "%s:%q\n", HashBody, in.Body)
+	}
+	if all || use[HashAttachment] {
+		digests := make([]string, 0, len(in.Files))
+		for _, af := range in.Files {
+			if af.Data != nil {
+				sum := sha256.Sum256(af.Data)
+				digests = append(digests, af.Name+"="+hex.EncodeToString(sum[:]))
+				continue
+			}
+			digest, err := fileDigest(af.FilePath)
+			if err != nil {
+				return "", err
+			}
+			digests = append(digests, af.Name+"="+digest)
+		}
+		sort.Strings(digests)
+		fmt.Fprintf(h, "%s:%q\n", HashAttachment, digests)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileDigest returns hex sha256 of file content
+func fileDigest(filename string) (string, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("open attachment %s error: %w", filename, err)
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", fmt.Errorf("read attachment %s error: %w", filename, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
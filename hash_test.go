@@ -0,0 +1,71 @@
+package sendme_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipsusila/sendme"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageHash(t *testing.T) {
+	dir := t.TempDir()
+	file1 := filepath.Join(dir, "a.pdf")
+	file2 := filepath.Join(dir, "b.pdf")
+	assert.NoError(t, os.WriteFile(file1, []byte("invoice 1"), 0644))
+	assert.NoError(t, os.WriteFile(file2, []byte("invoice 2"), 0644))
+
+	in := sendme.HashInput{
+		Recipients: []string{"alice@example.com", "Bob@example.com"},
+		Subject:    "Invoice",
+		Body:       "Dear Alice",
+		Files:      []*sendme.AttachmentFile{{FilePath: file1}, {FilePath: file2}},
+	}
+	h1, err := sendme.MessageHash(nil, &in)
+	assert.NoError(t, err)
+
+	// order of recipients/attachments and case of address does not matter
+	same := in
+	same.Recipients = []string{"bob@example.com", "alice@example.com"}
+	same.Files = []*sendme.AttachmentFile{{FilePath: file2}, {FilePath: file1}}
+	h2, err := sendme.MessageHash(nil, &same)
+	assert.NoError(t, err)
+	assert.Equal(t, h1, h2)
+
+	// different content
+	other := in
+	other.Body = "Dear Bob"
+	h3, err := sendme.MessageHash(nil, &other)
+	assert.NoError(t, err)
+	assert.NotEqual(t, h1, h3)
+
+	// body not part of hash
+	parts := []string{sendme.HashRecipient, sendme.HashSubject}
+	h4, err := sendme.MessageHash(parts, &in)
+	assert.NoError(t, err)
+	h5, err := sendme.MessageHash(parts, &other)
+	assert.NoError(t, err)
+	assert.Equal(t, h4, h5)
+
+	_, err = sendme.MessageHash([]string{"date"}, &in)
+	assert.Error(t, err)
+}
+
+func TestHashPartsRecipient(t *testing.T) {
+	conf := sendConfig(t, "Name,Email\nAlice,alice@example.com\nBob,bob@example.com\n", "Hello")
+	d := conf.Delivery
+	d.DuplicateCheck = sendme.DuplicateByHash
+
+	// without recipient, identical message to Bob would be skipped
+	d.HashParts = []string{sendme.HashSubject, sendme.HashBody}
+	_, err := sendme.NewMailer(conf)
+	assert.ErrorContains(t, err, "recipient")
+
+	d.HashParts = []string{sendme.HashRecipient, sendme.HashBody}
+	tr := recordTransport{}
+	st, err := tr.send(t, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+	assert.Len(t, tr.messages, 2)
+}
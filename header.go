@@ -0,0 +1,156 @@
+package sendme
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// mailHeaders stores rendered subject and headers of a row
+type mailHeaders struct {
+	subject  string
+	fromName string
+	replyTo  string
+	headers  [][2]string
+}
+
+// headerTemplates renders subject, from display name, reply-to and
+// custom headers using the same data as message body
+type headerTemplates struct {
+	subject  *template.Template
+	fromName *template.Template
+	replyTo  *template.Template
+	names    []string
+	headers  map[string]*template.Template
+	// subject column is parsed per row with the same functions and option
+	funcs []map[string]any
+	opt   string
+}
+
+func newHeaderTemplates(d *DeliveryConfig, funcs ...map[string]any) (*headerTemplates, error) {
+	h := headerTemplates{
+		headers: make(map[string]*template.Template),
+		funcs:   funcs,
+	}
+	var err error
+	if h.subject, err = parseHeaderTemplate("subject", d.DefaultSubject, funcs); err != nil {
+		return nil, err
+	}
+	if h.fromName, err = parseHeaderTemplate("fromName", d.FromName, funcs); err != nil {
+		return nil, err
+	}
+	if h.replyTo, err = parseHeaderTemplate("replyTo", d.ReplyTo, funcs); err != nil {
+		return nil, err
+	}
+	for name, text := range d.Headers {
+		tpl, err := parseHeaderTemplate(name, text, funcs)
+		if err != nil {
+			return nil, err
+		}
+		h.names = append(h.names, name)
+		h.headers[name] = tpl
+	}
+	sort.Strings(h.names)
+	return &h, nil
+}
+
+// templates returns all header templates
+func (h *headerTemplates) templates() []*template.Template {
+	tpls := []*template.Template{h.subject, h.fromName, h.replyTo}
+	for _, name := range h.names {
+		tpls = append(tpls, h.headers[name])
+	}
+	return tpls
+}
+
+// option sets option of all header templates, including subject
+// parsed from data column
+func (h *headerTemplates) option(opt string) {
+	h.opt = opt
+	for _, tpl := range h.templates() {
+		tpl.Option(opt)
+	}
+}
+
+func parseHeaderTemplate(name, text string, funcs []map[string]any) (*template.Template, error) {
+	tpl := template.New(name).Funcs(sprig.TxtFuncMap())
+	for _, fm := range funcs {
+		tpl.Funcs(fm)
+	}
+	tpl, err := tpl.Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s template error: %w", name, err)
+	}
+	return tpl, nil
+}
+
+func executeHeader(tpl *template.Template, datum MailData) (string, error) {
+	var sb strings.Builder
+	if err := tpl.Execute(&sb, datum); err != nil {
+		return "", fmt.Errorf("execute %s template error: %w", tpl.Name(), err)
+	}
+	// header value must be in a single line
+	return strings.Join(strings.Fields(sb.String()), " "), nil
+}
+
+// render executes all header templates. Subject field value (if configured
+// and not empty) is a template as well and replaces default subject.
+func (h *headerTemplates) render(datum MailData, subjectField string) (*mailHeaders, error) {
+	mh := mailHeaders{}
+	subject := h.subject
+	if text := datum.StringDefault(subjectField, ""); subjectField != "" && text != "" {
+		tpl, err := parseHeaderTemplate(subjectField, text, h.funcs)
+		if err != nil {
+			return nil, err
+		}
+		if h.opt != "" {
+			tpl.Option(h.opt)
+		}
+		subject = tpl
+	}
+	var err error
+	if mh.subject, err = executeHeader(subject, datum); err != nil {
+		return nil, err
+	}
+	if mh.fromName, err = executeHeader(h.fromName, datum); err != nil {
+		return nil, err
+	}
+	if mh.replyTo, err = executeHeader(h.replyTo, datum); err != nil {
+		return nil, err
+	}
+	if mh.replyTo != "" {
+		list, err := ParseAddressList(mh.replyTo)
+		if err != nil || len(list) != 1 {
+			return nil, fmt.Errorf("reply-to `%s` must be a single valid address", mh.replyTo)
+		}
+		mh.replyTo = list[0].String()
+	}
+	for _, name := range h.names {
+		val, err := executeHeader(h.headers[name], datum)
+		if err != nil {
+			return nil, err
+		}
+		// empty header is omitted
+		if val != "" {
+			mh.headers = append(mh.headers, [2]string{name, val})
+		}
+	}
+	return &mh, nil
+}
+
+// withName replaces display name of an address
+func withName(address, name string) (string, error) {
+	if name == "" || address == "" {
+		return address, nil
+	}
+	addr, err := netmail.ParseAddress(address)
+	if err != nil {
+		return "", fmt.Errorf("parse address `%s` error: %w", address, err)
+	}
+	addr.Name = name
+	return addr.String(), nil
+}
@@ -2,6 +2,7 @@ package sendme
 
 import (
 	"errors"
+	"fmt"
 	"html/template"
 
 	"github.com/Masterminds/sprig/v3"
@@ -12,7 +13,63 @@ func ParseHtmlTemplates(conf *Config) (Executer, error) {
 	if conf == nil || conf.Delivery == nil || len(conf.Delivery.TemplateFiles) == 0 {
 		return nil, errors.New("template file(s) not specified")
 	}
-	filenames := conf.Delivery.TemplateFiles
-	tpl := template.New(conf.Delivery.TemplateName).Funcs(sprig.FuncMap())
-	return tpl.ParseFiles(filenames...)
+	loc, err := defaultLocale(conf.Delivery)
+	if err != nil {
+		return nil, err
+	}
+	mf, err := newMailFuncs(conf.Delivery)
+	if err != nil {
+		return nil, err
+	}
+	return parseHtmlTemplates(conf.Delivery, loc, mf.funcMap())
+}
+
+// parseHtmlTemplates parse templates of the locale with additional functions
+func parseHtmlTemplates(d *DeliveryConfig, loc *locale, funcs ...map[string]any) (Executer, error) {
+	ts, err := newTemplateSet(d.TemplateName, loc.paths(d.TemplateFiles), loc.path(d.LayoutFile), loc.paths(d.PartialPaths), splitTemplates(d))
+	if err != nil {
+		return nil, err
+	}
+	return parseHtmlFiles(ts, append([]map[string]any{loc.funcMap()}, funcs...))
+}
+
+func parseHtmlFiles(ts *templateSet, funcs []map[string]any) (Executer, error) {
+	tpl := template.New(ts.name).Funcs(sprig.FuncMap())
+	for _, fm := range funcs {
+		tpl.Funcs(fm)
+	}
+	var mains []*templateFile
+	for _, f := range ts.files {
+		if ts.split && f.level == levelMain {
+			mains = append(mains, f)
+			continue
+		}
+		t := tpl
+		if f.name != tpl.Name() {
+			t = tpl.New(f.name)
+		}
+		if _, err := t.Parse(f.text); err != nil {
+			return nil, fmt.Errorf("parse template %s error: %w", f.path, err)
+		}
+	}
+	if !ts.split {
+		if t := tpl.Lookup(ts.name); t != nil {
+			return t, nil
+		}
+		return nil, fmt.Errorf("template `%s` not found", ts.name)
+	}
+
+	// every main template with its own copy of layout
+	lt := layoutTemplates{mains: make(map[string]Executer)}
+	for _, f := range mains {
+		clone, err := tpl.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("clone layout error: %w", err)
+		}
+		if _, err := clone.New(f.name).Parse(f.text); err != nil {
+			return nil, fmt.Errorf("parse template %s error: %w", f.path, err)
+		}
+		lt.mains[f.name] = clone.Lookup(ts.name)
+	}
+	return lt.withDefault(ts.main)
 }
@@ -0,0 +1,357 @@
+package sendme
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HtmlToText converts rendered HTML into plain text.
+// Links are written as numbered footnotes, data tables are laid out as
+// columns and layout tables (containing a nested table) as blocks.
+func HtmlToText(src string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", fmt.Errorf("parse html error: %w", err)
+	}
+
+	links := []string{}
+	tw := textWriter{links: &links}
+	tw.walk(doc)
+
+	text := tw.String()
+	if len(links) > 0 {
+		var sb strings.Builder
+		sb.WriteString(text)
+		sb.WriteString("\n\n")
+		for i, link := range links {
+			fmt.Fprintf(&sb, "[%d] %s\n", i+1, link)
+		}
+		text = sb.String()
+	}
+	return cleanupText(text), nil
+}
+
+// textWriter accumulates text, collapsing whitespace outside <pre>
+type textWriter struct {
+	sb       strings.Builder
+	links    *[]string
+	space    bool
+	newlines int
+	pre      int
+	lists    []int
+}
+
+func (t *textWriter) String() string {
+	return t.sb.String()
+}
+
+// text writes inline text
+func (t *textWriter) text(s string) {
+	if t.pre > 0 {
+		t.write(s)
+		return
+	}
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" {
+			t.space = true
+		}
+		return
+	}
+	if isSpace(s[0]) {
+		t.space = true
+	}
+	for i, w := range words {
+		if i > 0 {
+			t.space = true
+		}
+		if t.space && t.newlines == 0 && t.sb.Len() > 0 {
+			t.sb.WriteByte(' ')
+		}
+		t.write(w)
+	}
+	t.space = isSpace(s[len(s)-1])
+}
+
+func (t *textWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	t.sb.WriteString(s)
+	t.space = false
+	t.newlines = 0
+	for i := len(s) - 1; i >= 0 && s[i] == '\n'; i-- {
+		t.newlines++
+	}
+}
+
+// block ensures text ends with at least n newlines
+func (t *textWriter) block(n int) {
+	if t.sb.Len() == 0 {
+		return
+	}
+	for t.newlines < n {
+		t.sb.WriteByte('\n')
+		t.newlines++
+	}
+	t.space = false
+}
+
+func (t *textWriter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		t.text(n.Data)
+		return
+	case html.DocumentNode:
+		t.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title, atom.Template:
+		return
+	case atom.Br:
+		t.write("\n")
+	case atom.Hr:
+		t.block(1)
+		t.write(strings.Repeat("-", 40) + "\n")
+	case atom.P, atom.Div, atom.Blockquote, atom.Section, atom.Article,
+		atom.Header, atom.Footer, atom.Address:
+		t.block(2)
+		t.children(n)
+		t.block(2)
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		t.block(2)
+		start := t.sb.Len()
+		t.children(n)
+		title := strings.TrimSpace(t.sb.String()[start:])
+		if n.DataAtom == atom.H1 || n.DataAtom == atom.H2 {
+			underline := "="
+			if n.DataAtom == atom.H2 {
+				underline = "-"
+			}
+			t.write("\n" + strings.Repeat(underline, utf8.RuneCountInString(title)))
+		}
+		t.block(2)
+	case atom.Pre:
+		t.block(2)
+		t.pre++
+		t.children(n)
+		t.pre--
+		t.block(2)
+	case atom.Ul, atom.Ol:
+		t.block(1)
+		t.lists = append(t.lists, 0)
+		if n.DataAtom == atom.Ul {
+			t.lists[len(t.lists)-1] = -1
+		}
+		t.children(n)
+		t.lists = t.lists[:len(t.lists)-1]
+		t.block(1)
+	case atom.Li:
+		t.block(1)
+		bullet := "- "
+		depth := len(t.lists)
+		if depth > 0 && t.lists[depth-1] >= 0 {
+			t.lists[depth-1]++
+			bullet = fmt.Sprintf("%d. ", t.lists[depth-1])
+		}
+		if depth > 1 {
+			t.write(strings.Repeat("  ", depth-1))
+		}
+		t.write(bullet)
+		t.children(n)
+		t.block(1)
+	case atom.A:
+		t.children(n)
+		href := strings.TrimSpace(attr(n, "href"))
+		if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(href, "cid:") {
+			return
+		}
+		if strings.TrimSpace(nodeText(n)) == strings.TrimPrefix(href, "mailto:") {
+			return
+		}
+		t.write(fmt.Sprintf(" [%d]", t.link(href)))
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			t.text(" [" + alt + "] ")
+		}
+	case atom.Table:
+		t.block(2)
+		if hasNested(n, atom.Table) {
+			// layout table, cells are written as blocks
+			t.cells(n)
+		} else {
+			t.table(n)
+		}
+		t.block(2)
+	default:
+		t.children(n)
+	}
+}
+
+func (t *textWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		t.walk(c)
+	}
+}
+
+// link returns footnote number of href, same link is numbered once
+func (t *textWriter) link(href string) int {
+	for i, l := range *t.links {
+		if l == href {
+			return i + 1
+		}
+	}
+	*t.links = append(*t.links, href)
+	return len(*t.links)
+}
+
+// cells writes every cell of layout table as block
+func (t *textWriter) cells(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.DataAtom {
+		case atom.Td, atom.Th:
+			t.block(1)
+			t.children(c)
+			t.block(1)
+		default:
+			if c.Type == html.ElementNode {
+				t.cells(c)
+			}
+		}
+	}
+}
+
+// hasNested checks whether any descendant of n is element a
+func hasNested(n *html.Node, a atom.Atom) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == a || hasNested(c, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// table lays out rows of data table as text columns, header row is underlined.
+// Cells are single line, colspan and rowspan are not supported.
+func (t *textWriter) table(n *html.Node) {
+	var rows [][]string
+	header := -1
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				collect(c)
+			case atom.Tr:
+				var cells []string
+				allTh := true
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.DataAtom != atom.Td && cell.DataAtom != atom.Th {
+						continue
+					}
+					allTh = allTh && cell.DataAtom == atom.Th
+					cw := textWriter{links: t.links}
+					cw.children(cell)
+					cells = append(cells, strings.Join(strings.Fields(cw.String()), " "))
+				}
+				if len(cells) == 0 {
+					continue
+				}
+				if allTh && len(rows) == 0 {
+					header = 0
+				}
+				rows = append(rows, cells)
+			}
+		}
+	}
+	collect(n)
+
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := utf8.RuneCountInString(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+	for r, row := range rows {
+		var sb strings.Builder
+		for i, cell := range row {
+			if i > 0 {
+				sb.WriteString("  ")
+			}
+			sb.WriteString(cell)
+			if i < len(row)-1 {
+				sb.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)))
+			}
+		}
+		t.write(strings.TrimRight(sb.String(), " ") + "\n")
+		if r == header {
+			var ul []string
+			for _, w := range widths {
+				ul = append(ul, strings.Repeat("-", w))
+			}
+			t.write(strings.Join(ul, "  ") + "\n")
+		}
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+// cleanupText trims trailing spaces and collapses multiple blank lines
+func cleanupText(s string) string {
+	lines := strings.Split(s, "\n")
+	out := make([]string, 0, len(lines))
+	blank := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blank++
+			if blank > 1 {
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n")) + "\n"
+}
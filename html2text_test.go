@@ -0,0 +1,76 @@
+package sendme_test
+
+import (
+	"testing"
+
+	"github.com/ipsusila/sendme"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHtmlToText(t *testing.T) {
+	src := `<html><head><style>p { color: red; }</style></head><body>
+<h1>Invoice</h1>
+<p>Dear <b>Alice</b>,<br>please visit <a href="https://example.com/pay">payment page</a>
+or mail <a href="mailto:billing@example.com">billing@example.com</a>.</p>
+<ul><li>First</li><li>Second</li></ul>
+<table>
+  <tr><th>Item</th><th>Price</th></tr>
+  <tr><td>Book</td><td>10.000</td></tr>
+  <tr><td>Long item name</td><td>5.000</td></tr>
+</table>
+</body></html>`
+
+	expected := `Invoice
+=======
+
+Dear Alice,
+please visit payment page [1] or mail billing@example.com.
+
+- First
+- Second
+
+Item            Price
+--------------  ------
+Book            10.000
+Long item name  5.000
+
+[1] https://example.com/pay
+`
+	text, err := sendme.HtmlToText(src)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, text)
+}
+
+func TestHtmlToTextEdgeCases(t *testing.T) {
+	src := `<html><head><title>Ignored</title><script>var a = "<p>x</p>";</script></head><body>
+<table width="100%"><tr><td>
+  <table><tr><td><img src="logo.png" alt="Logo"></td></tr></table>
+</td></tr><tr><td>
+  <p>Tom &amp; Jerry&nbsp;&lt;3 <a href="https://example.com/a">here</a></p>
+  <ol><li>One<ul><li>Nested</li></ul></li><li>Two <a href="https://example.com/a">again</a></li></ol>
+  <pre>  keep   spacing
+    here</pre>
+  <table><tr><td>Total</td><td><a href="https://example.com/b">10</a></td></tr></table>
+</td></tr></table>
+</body></html>`
+
+	expected := `[Logo]
+
+Tom & Jerry <3 here [1]
+
+1. One
+  - Nested
+2. Two again [1]
+
+  keep   spacing
+    here
+
+Total  10 [2]
+
+[1] https://example.com/a
+[2] https://example.com/b
+`
+	text, err := sendme.HtmlToText(src)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, text)
+}
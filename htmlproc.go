@@ -0,0 +1,227 @@
+package sendme
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlProcessor post-processes rendered HTML: moves stylesheet rules into
+// style attributes, embeds local images as inline attachments and
+// optionally minifies the result.
+type htmlProcessor struct {
+	inlineCss   bool
+	embedImages bool
+	minify      bool
+	imageRoot   string
+}
+
+// newHtmlProcessor returns nil if no processing is configured
+func newHtmlProcessor(d *DeliveryConfig) *htmlProcessor {
+	if !d.InlineCss && !d.EmbedImages && !d.Minify {
+		return nil
+	}
+	p := htmlProcessor{
+		inlineCss:   d.InlineCss,
+		embedImages: d.EmbedImages,
+		minify:      d.Minify,
+		imageRoot:   d.ImageRoot,
+	}
+	// images are relative to template by default
+	if p.imageRoot == "" && len(d.TemplateFiles) > 0 {
+		p.imageRoot = d.TemplateFiles[0]
+		if fi, err := os.Stat(p.imageRoot); err != nil || !fi.IsDir() {
+			p.imageRoot = filepath.Dir(p.imageRoot)
+		}
+	}
+	return &p
+}
+
+// Process returns processed HTML and images to be attached inline
+func (p *htmlProcessor) Process(src string) (string, []*AttachmentFile, error) {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", nil, fmt.Errorf("parse html error: %w", err)
+	}
+
+	if p.inlineCss {
+		p.inlineStylesheets(doc)
+	}
+	var images []*AttachmentFile
+	if p.embedImages {
+		if images, err = p.embed(doc); err != nil {
+			return "", nil, err
+		}
+	}
+	if p.minify {
+		minifyNode(doc, false)
+	}
+
+	var sb strings.Builder
+	if err := html.Render(&sb, doc); err != nil {
+		return "", nil, fmt.Errorf("render html error: %w", err)
+	}
+	return sb.String(), images, nil
+}
+
+// inlineStylesheets moves rules in <style> elements to style attributes.
+// Rules which can not be inlined (e.g. @media, :hover) stay in <style>.
+func (p *htmlProcessor) inlineStylesheets(doc *html.Node) {
+	var styles []*html.Node
+	var find func(*html.Node)
+	find = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Style {
+			media := strings.ToLower(strings.TrimSpace(attr(n, "media")))
+			if media == "" || media == "all" || media == "screen" {
+				styles = append(styles, n)
+			}
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			find(c)
+		}
+	}
+	find(doc)
+
+	var rules []*cssRule
+	order := 0
+	for _, style := range styles {
+		r, residual := parseStylesheet(nodeText(style), &order)
+		rules = append(rules, r...)
+		for c := style.FirstChild; c != nil; c = style.FirstChild {
+			style.RemoveChild(c)
+		}
+		if residual == "" {
+			style.Parent.RemoveChild(style)
+		} else {
+			style.AppendChild(&html.Node{Type: html.TextNode, Data: residual})
+		}
+	}
+	inlineStyles(doc, rules)
+}
+
+// embed replaces local image src with cid reference
+func (p *htmlProcessor) embed(doc *html.Node) ([]*AttachmentFile, error) {
+	var images []*AttachmentFile
+	cids := map[string]string{}
+	names := map[string]bool{}
+
+	var walk func(*html.Node) error
+	walk = func(n *html.Node) error {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Img {
+			src := strings.TrimSpace(attr(n, "src"))
+			if src != "" && isLocalRef(src) {
+				cid, ok := cids[src]
+				if !ok {
+					path, err := url.PathUnescape(src)
+					if err != nil {
+						path = src
+					}
+					if !filepath.IsAbs(path) && p.imageRoot != "" {
+						path = filepath.Join(p.imageRoot, path)
+					}
+					if _, err := os.Stat(path); err != nil {
+						return fmt.Errorf("embed image `%s` error: %w", src, err)
+					}
+
+					// content id is the attachment name, must be unique
+					cid = filepath.Base(path)
+					for i := 2; names[cid]; i++ {
+						ext := filepath.Ext(path)
+						cid = strings.TrimSuffix(filepath.Base(path), ext) + "-" + strconv.Itoa(i) + ext
+					}
+					names[cid] = true
+					cids[src] = cid
+					images = append(images, &AttachmentFile{
+						Key:      "img",
+						FilePath: path,
+						Name:     cid,
+						Inline:   true,
+					})
+				}
+				setAttr(n, "src", "cid:"+cid)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(doc); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// isLocalRef check whether reference is local file, i.e. has no scheme
+func isLocalRef(ref string) bool {
+	if strings.HasPrefix(ref, "//") {
+		return false
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return false
+	}
+	// windows drive letter is parsed as scheme
+	return u.Scheme == "" || (len(u.Scheme) == 1 && filepath.IsAbs(ref))
+}
+
+// minifyNode removes comments and collapses whitespace of text nodes
+// outside pre, textarea, script and style elements.
+func minifyNode(n *html.Node, keep bool) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch c.Type {
+		case html.CommentNode:
+			// keep conditional comments for outlook
+			if !strings.HasPrefix(strings.TrimSpace(c.Data), "[if") {
+				n.RemoveChild(c)
+			}
+		case html.TextNode:
+			if !keep {
+				c.Data = collapseSpace(c.Data)
+				if c.Data == "" {
+					n.RemoveChild(c)
+				}
+			}
+		case html.ElementNode:
+			switch c.DataAtom {
+			case atom.Pre, atom.Textarea, atom.Script, atom.Style:
+				minifyNode(c, true)
+			default:
+				minifyNode(c, keep)
+			}
+		default:
+			minifyNode(c, keep)
+		}
+		c = next
+	}
+}
+
+func collapseSpace(s string) string {
+	var sb strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if isSpace(s[i]) {
+			space = true
+			continue
+		}
+		if space {
+			sb.WriteByte(' ')
+			space = false
+		}
+		sb.WriteByte(s[i])
+	}
+	if space {
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
@@ -0,0 +1,206 @@
+package sendme
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// HttpTransportConfig posts every message to HTTP API of email provider.
+// Payload is a text template of Message (payloadTemplate or payloadFile),
+// default is JSON of message parts with base64 attachments.
+type HttpTransportConfig struct {
+	Url             string            `json:"url"`
+	Method          string            `json:"method"`
+	Authorization   string            `json:"authorization"`
+	Headers         map[string]string `json:"headers"`
+	ContentType     string            `json:"contentType"`
+	PayloadTemplate string            `json:"payloadTemplate"`
+	PayloadFile     string            `json:"payloadFile"`
+	Timeout         string            `json:"timeout"`
+}
+
+// httpAttachment is attachment of default payload
+type httpAttachment struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Inline  bool   `json:"inline,omitempty"`
+}
+
+// httpPayload is default JSON payload
+type httpPayload struct {
+	MessageID   string            `json:"messageId"`
+	From        string            `json:"from"`
+	Sender      string            `json:"sender,omitempty"`
+	ReplyTo     string            `json:"replyTo,omitempty"`
+	To          []string          `json:"to"`
+	Cc          []string          `json:"cc,omitempty"`
+	Bcc         []string          `json:"bcc,omitempty"`
+	Subject     string            `json:"subject"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Text        string            `json:"text,omitempty"`
+	Html        string            `json:"html,omitempty"`
+	Attachments []*httpAttachment `json:"attachments,omitempty"`
+}
+
+// httpTransport sends message as HTTP request
+type httpTransport struct {
+	conf   *HttpTransportConfig
+	client *http.Client
+	tpl    *template.Template
+}
+
+func newHttpTransport(conf *HttpTransportConfig) (*httpTransport, error) {
+	if conf == nil || conf.Url == "" {
+		return nil, errors.New("http transport url not specified")
+	}
+	t := httpTransport{conf: conf, client: &http.Client{Timeout: 30 * time.Second}}
+	if conf.Timeout != "" {
+		d, err := time.ParseDuration(conf.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("parsing http timeout `%s` error: %w", conf.Timeout, err)
+		}
+		t.client.Timeout = d
+	}
+
+	payload := conf.PayloadTemplate
+	if conf.PayloadFile != "" {
+		content, err := os.ReadFile(conf.PayloadFile)
+		if err != nil {
+			return nil, fmt.Errorf("read payload template %s error: %w", conf.PayloadFile, err)
+		}
+		payload = string(content)
+	}
+	if payload != "" {
+		funcs := template.FuncMap{
+			"base64":     encodeBase64,
+			"attachment": attachmentBase64,
+		}
+		tpl, err := template.New("payload").Funcs(sprig.TxtFuncMap()).Funcs(funcs).Parse(payload)
+		if err != nil {
+			return nil, fmt.Errorf("parse payload template error: %w", err)
+		}
+		t.tpl = tpl
+	}
+	return &t, nil
+}
+
+// encodeBase64 encodes string or bytes
+func encodeBase64(v any) (string, error) {
+	switch s := v.(type) {
+	case string:
+		return base64.StdEncoding.EncodeToString([]byte(s)), nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(s), nil
+	}
+	return "", fmt.Errorf("base64: unsupported type %T", v)
+}
+
+// attachmentBase64 returns base64 content of attachment
+func attachmentBase64(af *AttachmentFile) (string, error) {
+	data := af.Data
+	if data == nil {
+		var err error
+		if data, err = os.ReadFile(af.FilePath); err != nil {
+			return "", fmt.Errorf("read attachment %s error: %w", af.FilePath, err)
+		}
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// payload returns request body of the message
+func (t *httpTransport) payload(msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if t.tpl != nil {
+		if err := t.tpl.Execute(&buf, msg); err != nil {
+			return nil, fmt.Errorf("execute payload template error: %w", err)
+		}
+		return buf.Bytes(), nil
+	}
+
+	p := httpPayload{
+		MessageID: msg.MessageID,
+		From:      msg.From,
+		Sender:    msg.Sender,
+		ReplyTo:   msg.ReplyTo,
+		To:        msg.To,
+		Cc:        msg.Cc,
+		Bcc:       msg.Bcc,
+		Subject:   msg.Subject,
+		Headers:   msg.Headers,
+		Text:      msg.Text,
+		Html:      msg.Html,
+	}
+	for _, af := range msg.Attachments {
+		content, err := attachmentBase64(af)
+		if err != nil {
+			return nil, err
+		}
+		p.Attachments = append(p.Attachments, &httpAttachment{Name: af.Name, Content: content, Inline: af.Inline})
+	}
+	if err := json.NewEncoder(&buf).Encode(&p); err != nil {
+		return nil, fmt.Errorf("encode payload error: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Send posts message. Status 429 and 5xx are temporary failures,
+// other status outside 2xx is permanent.
+func (t *httpTransport) Send(ctx context.Context, msg *Message) (*DeliveryResult, error) {
+	body, err := t.payload(msg)
+	if err != nil {
+		return nil, err
+	}
+	method := t.conf.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), t.conf.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create http request error: %w", err)
+	}
+	contentType := t.conf.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	if t.conf.Authorization != "" {
+		req.Header.Set("Authorization", t.conf.Authorization)
+	}
+	for k, v := range t.conf.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res := DeliveryResult{Server: req.URL.Host}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return &res, err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	res.Code = resp.StatusCode
+	res.Reply = strings.TrimSpace(string(reply))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return &res, nil
+	}
+	return &res, &DeliveryError{
+		Code:      resp.StatusCode,
+		Message:   res.Reply,
+		Permanent: resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500,
+	}
+}
+
+func (t *httpTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,201 @@
+package sendme
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery outcome recorded in journal
+const (
+	OutcomeSent     = "sent"
+	OutcomeFailed   = "failed"
+	OutcomeRejected = "rejected"
+	OutcomeImported = "imported"
+)
+
+// JournalEntry records delivery of one message
+type JournalEntry struct {
+	Time      time.Time `json:"time"`
+	Row       int       `json:"row,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	To        []string  `json:"to"`
+	Cc        []string  `json:"cc,omitempty"`
+	Bcc       []string  `json:"bcc,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Variant   string    `json:"variant,omitempty"`
+	MessageID string    `json:"messageId,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	Code      int       `json:"code,omitempty"`
+	Reply     string    `json:"reply,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	Server    string    `json:"server,omitempty"`
+	Outcome   string    `json:"outcome"`
+}
+
+// Delivered returns true if message has been sent (or imported from sent list)
+func (e *JournalEntry) Delivered() bool {
+	return e.Outcome == OutcomeSent || e.Outcome == OutcomeImported
+}
+
+// Rejected returns true if message has been rejected permanently (5xx reply)
+func (e *JournalEntry) Rejected() bool {
+	return e.Outcome == OutcomeRejected
+}
+
+// SetError stores SMTP reply code/text of the error.
+// Permanent (5xx) reply is recorded as rejected.
+func (e *JournalEntry) SetError(err error) {
+	e.Outcome = OutcomeFailed
+	e.Reply = err.Error()
+	var tpe *textproto.Error
+	if errors.As(err, &tpe) {
+		e.Code = tpe.Code
+		e.Reply = tpe.Msg
+		if tpe.Code >= 500 {
+			e.Outcome = OutcomeRejected
+		}
+	}
+	var de *DeliveryError
+	if errors.As(err, &de) {
+		e.Code = de.Code
+		e.Reply = de.Message
+		if de.Permanent {
+			e.Outcome = OutcomeRejected
+		}
+	}
+}
+
+// ReadJournal reads all entries from journal file (JSON Lines).
+// Missing file is not an error.
+func ReadJournal(filename string) ([]*JournalEntry, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open journal %s error: %w", filename, err)
+	}
+	defer fd.Close()
+
+	entries := []*JournalEntry{}
+	scan := bufio.NewScanner(fd)
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scan.Scan(); n++ {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" {
+			continue
+		}
+		e := JournalEntry{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("journal %s line %d error: %w", filename, n, err)
+		}
+		entries = append(entries, &e)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, fmt.Errorf("read journal %s error: %w", filename, err)
+	}
+
+	return entries, nil
+}
+
+// JournalWriter appends entries to journal file.
+// It is safe for concurrent use.
+type JournalWriter struct {
+	mu  sync.Mutex
+	fd  *os.File
+	enc *json.Encoder
+}
+
+// OpenJournal opens journal file for appending
+func OpenJournal(filename string) (*JournalWriter, error) {
+	fd, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal %s: %w", filename, err)
+	}
+	return &JournalWriter{fd: fd, enc: json.NewEncoder(fd)}, nil
+}
+
+// Write appends one entry
+func (j *JournalWriter) Write(e *JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.enc.Encode(e); err != nil {
+		return fmt.Errorf("write journal error: %w", err)
+	}
+	return nil
+}
+
+// Close the journal file
+func (j *JournalWriter) Close() error {
+	return j.fd.Close()
+}
+
+// ImportSentFile imports addresses in plain sent file (one address per line,
+// optionally followed by content hash) into journal. Returns number of imported addresses.
+func ImportSentFile(sentFile, journalFile string) (int, error) {
+	fd, err := os.Open(sentFile)
+	if err != nil {
+		return 0, fmt.Errorf("open file %s error: %w", sentFile, err)
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat file %s error: %w", sentFile, err)
+	}
+
+	jw, err := OpenJournal(journalFile)
+	if err != nil {
+		return 0, err
+	}
+	defer jw.Close()
+
+	n := 0
+	scan := bufio.NewScanner(fd)
+	for scan.Scan() {
+		// line: address [content hash]
+		fields := strings.Fields(scan.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		e := JournalEntry{
+			Time:    fi.ModTime(),
+			To:      []string{fields[0]},
+			Outcome: OutcomeImported,
+		}
+		if len(fields) > 1 {
+			e.Hash = fields[1]
+		}
+		if err := jw.Write(&e); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := scan.Err(); err != nil {
+		return n, fmt.Errorf("read file %s error: %w", sentFile, err)
+	}
+
+	return n, nil
+}
+
+// newMessageID generates unique Message-ID using domain of from address
+func newMessageID(from string) string {
+	domain := "localhost"
+	if list, err := ParseAddressList(from); err == nil && len(list) > 0 {
+		if _, d, ok := strings.Cut(list[0].Address, "@"); ok && d != "" {
+			domain = d
+		}
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
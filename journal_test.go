@@ -0,0 +1,69 @@
+package sendme_test
+
+import (
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipsusila/sendme"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	sentFile := filepath.Join(dir, "sentaddr.txt")
+	journalFile := filepath.Join(dir, "journal.jsonl")
+	assert.NoError(t, os.WriteFile(sentFile, []byte("alice@example.com\n\nbob@example.com 0a1b2c\n"), 0644))
+
+	n, err := sendme.ImportSentFile(sentFile, journalFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	jw, err := sendme.OpenJournal(journalFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	failed := sendme.JournalEntry{
+		Time: time.Now(),
+		Row:  3,
+		Key:  "C-003",
+		To:   []string{"carol@example.com"},
+	}
+	failed.SetError(&textproto.Error{Code: 550, Msg: "mailbox unavailable"})
+	assert.NoError(t, jw.Write(&failed))
+	assert.NoError(t, jw.Close())
+
+	entries, err := sendme.ReadJournal(journalFile)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 3) {
+		assert.True(t, entries[0].Delivered())
+		assert.Equal(t, []string{"bob@example.com"}, entries[1].To)
+		assert.Equal(t, "0a1b2c", entries[1].Hash)
+		assert.False(t, entries[2].Delivered())
+		assert.True(t, entries[2].Rejected())
+		assert.Equal(t, 550, entries[2].Code)
+		assert.Equal(t, "mailbox unavailable", entries[2].Reply)
+		assert.Equal(t, "C-003", entries[2].Key)
+	}
+
+	entries, err = sendme.ReadJournal(filepath.Join(dir, "missing.jsonl"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestJournalRequired(t *testing.T) {
+	conf := sendConfig(t, "Name,Email\nAlice,alice@example.com\n", "Dear {{.Name}}")
+	d := conf.Delivery
+	d.SentFile = filepath.Join(t.TempDir(), "sentaddr.txt")
+	assert.NoError(t, os.WriteFile(d.SentFile, []byte("alice@example.com\n"), 0644))
+	d.JournalFile = ""
+	_, err := sendme.NewMailer(conf)
+	assert.ErrorContains(t, err, "journalFile")
+
+	// preview does not write journal
+	d.PreviewMode = true
+	_, err = sendme.NewMailer(conf)
+	assert.NoError(t, err)
+}
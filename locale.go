@@ -0,0 +1,271 @@
+package sendme
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+	"golang.org/x/text/number"
+	"gopkg.in/yaml.v3"
+)
+
+// localePlaceholder in template paths is replaced by locale name,
+// e.g. templates/{locale}/*.tpl
+const localePlaceholder = "{locale}"
+
+// Month and weekday names other than English, used by formatDate
+var localeDateNames = map[string][2][]string{
+	"id": {
+		{"Januari", "Februari", "Maret", "April", "Mei", "Juni", "Juli",
+			"Agustus", "September", "Oktober", "November", "Desember"},
+		{"Minggu", "Senin", "Selasa", "Rabu", "Kamis", "Jumat", "Sabtu"},
+	},
+}
+
+// Layouts tried when formatting date stored as string
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"02/01/2006",
+}
+
+// locale of template set
+type locale struct {
+	name    string
+	tag     language.Tag
+	printer *message.Printer
+}
+
+func newLocale(name string, cat catalog.Catalog) (*locale, error) {
+	tag, err := language.Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("parse locale %s error: %w", name, err)
+	}
+	l := locale{name: name, tag: tag}
+	if cat != nil {
+		l.printer = message.NewPrinter(tag, message.Catalog(cat))
+	} else {
+		l.printer = message.NewPrinter(tag)
+	}
+	return &l, nil
+}
+
+// path replaces locale placeholder in path
+func (l *locale) path(p string) string {
+	return strings.ReplaceAll(p, localePlaceholder, l.name)
+}
+
+func (l *locale) paths(ps []string) []string {
+	if ps == nil {
+		return nil
+	}
+	out := make([]string, len(ps))
+	for i, p := range ps {
+		out[i] = l.path(p)
+	}
+	return out
+}
+
+// funcMap returns locale aware template functions
+func (l *locale) funcMap() map[string]any {
+	return map[string]any{
+		"locale": func() string {
+			return l.name
+		},
+		"tr": func(key string, args ...any) string {
+			return l.printer.Sprintf(key, args...)
+		},
+		"formatNumber": l.formatNumber,
+		"formatCurrency": func(code string, v any) (string, error) {
+			unit, err := currency.ParseISO(code)
+			if err != nil {
+				return "", fmt.Errorf("formatCurrency: %w", err)
+			}
+			f, err := toFloat(v)
+			if err != nil {
+				return "", fmt.Errorf("formatCurrency: %w", err)
+			}
+			return l.printer.Sprint(currency.Symbol(unit.Amount(f))), nil
+		},
+		"formatDate": l.formatDate,
+	}
+}
+
+// formatNumber formats number with locale grouping and optional
+// number of decimals.
+func (l *locale) formatNumber(v any, decimals ...int) (string, error) {
+	f, err := toFloat(v)
+	if err != nil {
+		return "", fmt.Errorf("formatNumber: %w", err)
+	}
+	if len(decimals) == 0 {
+		return l.printer.Sprint(number.Decimal(f)), nil
+	}
+	return l.printer.Sprint(number.Decimal(f,
+		number.MinFractionDigits(decimals[0]),
+		number.MaxFractionDigits(decimals[0]))), nil
+}
+
+// formatDate formats time using Go layout with localised month/day names
+func (l *locale) formatDate(layout string, v any) (string, error) {
+	var t time.Time
+	switch val := v.(type) {
+	case time.Time:
+		t = val
+	case *time.Time:
+		t = *val
+	default:
+		str := strings.TrimSpace(valueString(v))
+		parsed := false
+		for _, dl := range dateLayouts {
+			if tv, err := time.ParseInLocation(dl, str, time.Local); err == nil {
+				t, parsed = tv, true
+				break
+			}
+		}
+		if !parsed {
+			return "", fmt.Errorf("formatDate: invalid date `%s`", str)
+		}
+	}
+
+	base, _ := l.tag.Base()
+	names, ok := localeDateNames[base.String()]
+	if !ok {
+		return t.Format(layout), nil
+	}
+	// format with placeholders to avoid replacing inside other words
+	layout = strings.NewReplacer("January", "\x00M\x00", "Monday", "\x00D\x00").Replace(layout)
+	return strings.NewReplacer(
+		"\x00M\x00", names[0][t.Month()-1],
+		"\x00D\x00", names[1][t.Weekday()],
+	).Replace(t.Format(layout)), nil
+}
+
+func toFloat(v any) (float64, error) {
+	switch val := v.(type) {
+	case float64:
+		return val, nil
+	case float32:
+		return float64(val), nil
+	case int:
+		return float64(val), nil
+	case int64:
+		return float64(val), nil
+	case int32:
+		return float64(val), nil
+	case decimal.Decimal:
+		f, _ := val.Float64()
+		return f, nil
+	case json.Number:
+		return val.Float64()
+	case nil:
+		return 0, errors.New("empty value")
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(valueString(v)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number `%v`", v)
+	}
+	return f, nil
+}
+
+// loadCatalog reads message catalog from JSON or YAML file of form
+// {locale: {key: message}}. Message may contain fmt verbs.
+// Messages of fallback locale are used for missing keys or locales.
+func loadCatalog(filename, fallback string) (catalog.Catalog, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read catalog %s error: %w", filename, err)
+	}
+	messages := map[string]map[string]string{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &messages)
+	default:
+		err = json.Unmarshal(content, &messages)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse catalog %s error: %w", filename, err)
+	}
+
+	opts := []catalog.Option{}
+	if fallback != "" {
+		tag, err := language.Parse(fallback)
+		if err != nil {
+			return nil, fmt.Errorf("parse locale %s error: %w", fallback, err)
+		}
+		opts = append(opts, catalog.Fallback(tag))
+	}
+	cat := catalog.NewBuilder(opts...)
+	for name, msgs := range messages {
+		tag, err := language.Parse(name)
+		if err != nil {
+			return nil, fmt.Errorf("catalog %s: parse locale %s error: %w", filename, name, err)
+		}
+		// missing keys are taken from fallback locale
+		for key, msg := range messages[fallback] {
+			if _, ok := msgs[key]; !ok {
+				msgs[key] = msg
+			}
+		}
+		for key, msg := range msgs {
+			if err := cat.SetString(tag, key, msg); err != nil {
+				return nil, fmt.Errorf("catalog %s: %w", filename, err)
+			}
+		}
+	}
+	return cat, nil
+}
+
+// loadLocales returns configured locales, the default locale comes first.
+// Without configuration, single "en" locale is returned.
+func loadLocales(d *DeliveryConfig) ([]*locale, error) {
+	def := d.DefaultLocale
+	if def == "" && len(d.Locales) > 0 {
+		def = d.Locales[0]
+	}
+	if def == "" {
+		def = "en"
+	}
+	names := []string{def}
+	for _, name := range d.Locales {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	var cat catalog.Catalog
+	if d.CatalogFile != "" {
+		var err error
+		if cat, err = loadCatalog(d.CatalogFile, def); err != nil {
+			return nil, err
+		}
+	}
+	locales := make([]*locale, len(names))
+	for i, name := range names {
+		loc, err := newLocale(name, cat)
+		if err != nil {
+			return nil, err
+		}
+		locales[i] = loc
+	}
+	return locales, nil
+}
+
+func defaultLocale(d *DeliveryConfig) (*locale, error) {
+	locales, err := loadLocales(d)
+	if err != nil {
+		return nil, err
+	}
+	return locales[0], nil
+}
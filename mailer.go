@@ -7,18 +7,29 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	netmail "net/mail"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"text/template"
 	"time"
 
 	mail "github.com/xhit/go-simple-mail/v2"
+	"golang.org/x/text/language"
 )
 
 // Html/Text message format
 const (
-	HtmlFormat  = "HTML"
-	PlainFormat = "PLAIN"
+	HtmlFormat     = "HTML"
+	PlainFormat    = "PLAIN"
+	MarkdownFormat = "MARKDOWN"
+)
+
+// Policy for combining per-row CC/BCC with global list
+const (
+	PolicyMerge   = "MERGE"
+	PolicyReplace = "REPLACE"
 )
 
 // Action to be taken before sending.
@@ -39,22 +50,41 @@ type Executer interface {
 // Mailer data structure
 type Mailer struct {
 	conf       *Config
-	data       *MailDataCollection
-	server     *mail.SMTPServer
-	ccList     []string
-	bccList    []string
-	tpl        Executer
+	servers    *serverSet
+	ccList     []*netmail.Address
+	bccList    []*netmail.Address
+	schema     *Schema
+	attach     *attachmentResolver
+	html       *htmlProcessor
+	pdfs       []*pdfGenerator
+	selectors  []*templateSelector
+	matcher    language.Matcher
+	funcs      *mailFuncs
+	userFuncs  map[string]any
+	parsed     bool
 	ui         Ui
-	sentWr     io.Writer
+	journal    *JournalWriter
 	sentList   []string
+	hashList   []string
 	resendList []string
-	intBetween time.Duration
+	limiter    *RateLimiter
+	retry      *retryPolicy
+	rejectList []string
+	transport  Transport
 }
 
 func NewMailer(conf *Config) (*Mailer, error) {
-	if conf == nil || conf.Server == nil || conf.Delivery == nil {
+	if conf == nil || conf.Delivery == nil {
 		return nil, errors.New("invalid/empty mail configuration")
 	}
+	// delivery journal is written unless messages are only previewed
+	if conf.Delivery.JournalFile == "" && !conf.Delivery.PreviewMode {
+		return nil, errors.New("journal file not specified (journalFile), it is required to send messages")
+	}
+	// servers are only needed by SMTP transport
+	if conf.UseSmtp() && len(conf.ServerList()) == 0 {
+		return nil, errors.New("server configuration not specified")
+	}
 
 	// construct mailer
 	m := Mailer{
@@ -66,44 +96,70 @@ func NewMailer(conf *Config) (*Mailer, error) {
 		return nil, err
 	}
 
-	// 1. Load data
-	m.data, err = NewMailDataCollection(conf)
-	if err != nil {
-		return nil, err
+	// 1. Configure server
+	if conf.UseSmtp() {
+		tlsConfig, err := conf.Tls.MakeTlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		m.servers, err = newServerSet(conf, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// 2. Configure server
-	m.server = mail.NewSMTPClient()
-	if err := conf.Server.Configure(m.server); err != nil {
+	// 2. Column schema
+	m.schema, err = NewSchema(conf.Delivery.Columns)
+	if err != nil {
 		return nil, err
 	}
-	m.server.TLSConfig, err = conf.Tls.MakeTlsConfig()
+
+	// 3. Attachments
+	m.attach, err = newAttachmentResolver(conf.Delivery)
 	if err != nil {
 		return nil, err
 	}
 
-	// 3. Get templates
+	// 4. Template functions, templates are parsed before sending
+	// so that additional functions can be registered with Funcs
 	switch conf.Delivery.MailFormat {
-	case HtmlFormat:
-		m.tpl, err = ParseHtmlTemplates(conf)
-	case PlainFormat:
-		m.tpl, err = ParseTextTemplates(conf)
+	case HtmlFormat, PlainFormat, MarkdownFormat:
 	default:
-		err = fmt.Errorf("unknown mail format: %s", conf.Delivery.MailFormat)
+		return nil, fmt.Errorf("unknown mail format: %s", conf.Delivery.MailFormat)
 	}
+	m.funcs, err = newMailFuncs(conf.Delivery)
 	if err != nil {
 		return nil, err
 	}
 
+	// 5. HTML post-processing
+	m.html = newHtmlProcessor(conf.Delivery)
+
+	switch strings.ToUpper(conf.Delivery.DuplicateCheck) {
+	case "", DuplicateByAddress, DuplicateByHash:
+	default:
+		return nil, fmt.Errorf("unknown duplicate check: %s", conf.Delivery.DuplicateCheck)
+	}
+	if _, err := MessageHash(conf.Delivery.HashParts, &HashInput{}); err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(conf.Delivery.DuplicateCheck, DuplicateByHash) && !hashesRecipient(conf.Delivery.HashParts) {
+		// same content sent to other address would be skipped
+		return nil, fmt.Errorf("hash parts must include `%s` when duplicate check is %s", HashRecipient, DuplicateByHash)
+	}
+	switch strings.ToUpper(conf.Delivery.AddressPolicy) {
+	case "", PolicyMerge, PolicyReplace:
+	default:
+		return nil, fmt.Errorf("unknown address policy: %s", conf.Delivery.AddressPolicy)
+	}
+
 	// parse cc/bcc
 	if cclist := conf.Delivery.CcList; cclist != "" {
 		cc, err := ParseAddressList(cclist)
 		if err != nil {
 			return nil, fmt.Errorf("parse CC-list %s error: %w", cclist, err)
 		}
-		for _, addr := range cc {
-			m.ccList = append(m.ccList, addr.String())
-		}
+		m.ccList = cc
 	}
 
 	if bcclist := conf.Delivery.BccList; bcclist != "" {
@@ -111,24 +167,157 @@ func NewMailer(conf *Config) (*Mailer, error) {
 		if err != nil {
 			return nil, fmt.Errorf("parse BCC-list %s error: %w", bcclist, err)
 		}
-		for _, addr := range bcc {
-			m.bccList = append(m.bccList, addr.String())
-		}
+		m.bccList = bcc
 	}
 
 	if err := m.readSentList(); err != nil {
 		return nil, err
 	}
 
-	// default interval between sending email
-	m.intBetween, err = time.ParseDuration(conf.Delivery.IntervalBetweenSend)
+	// rate limit shared by all workers, interval between sending
+	// email is used unless rate per minute is configured
+	interval, err := time.ParseDuration(conf.Delivery.IntervalBetweenSend)
+	if err != nil {
+		interval = time.Second
+	}
+	rl := conf.Delivery.RateLimit
+	if rl != nil && rl.StateFile == "" && conf.Delivery.JournalFile != "" {
+		// daily counters are kept next to journal
+		rc := *rl
+		rc.StateFile = strings.TrimSuffix(conf.Delivery.JournalFile, filepath.Ext(conf.Delivery.JournalFile)) + ".quota.json"
+		rl = &rc
+	}
+	m.limiter, err = NewRateLimiter(rl, interval)
 	if err != nil {
-		m.intBetween = time.Second
+		return nil, err
+	}
+	m.retry, err = newRetryPolicy(conf.Delivery.Retry)
+	if err != nil {
+		return nil, err
 	}
 
 	return &m, nil
 }
 
+// Funcs registers additional template functions. It must be called
+// before templates are parsed, i.e. before the first Send.
+func (m *Mailer) Funcs(funcMap map[string]any) (err error) {
+	if m.parsed {
+		return errors.New("templates already parsed, functions must be registered before sending")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid template function: %v", r)
+		}
+	}()
+	template.New("funcs").Funcs(funcMap)
+
+	if m.userFuncs == nil {
+		m.userFuncs = make(map[string]any)
+	}
+	for name, fn := range funcMap {
+		m.userFuncs[name] = fn
+	}
+	return nil
+}
+
+// parseTemplates parses header and message templates of every locale once
+func (m *Mailer) parseTemplates() error {
+	if m.parsed {
+		return nil
+	}
+	d := m.conf.Delivery
+	funcs := []map[string]any{m.funcs.funcMap(), m.userFuncs}
+
+	// templates of every locale, default locale first
+	locales, err := loadLocales(d)
+	if err != nil {
+		return err
+	}
+	tags := make([]language.Tag, len(locales))
+	m.selectors = nil
+	for i, loc := range locales {
+		sel, err := m.parseLocaleTemplates(loc, funcs)
+		if err != nil {
+			if len(locales) > 1 {
+				return fmt.Errorf("locale %s: %w", loc.name, err)
+			}
+			return err
+		}
+		m.selectors = append(m.selectors, sel)
+		tags[i] = loc.tag
+	}
+	m.matcher = language.NewMatcher(tags)
+
+	// PDF attachments use functions of the default locale
+	pdfFuncs := append([]map[string]any{locales[0].funcMap()}, funcs...)
+	if m.pdfs, err = newPdfGenerators(d, pdfFuncs); err != nil {
+		return err
+	}
+
+	m.parsed = true
+	return nil
+}
+
+// parseLocaleTemplates parses templates of the locale according to mail format
+func (m *Mailer) parseLocaleTemplates(loc *locale, funcs []map[string]any) (*templateSelector, error) {
+	d := m.conf.Delivery
+	if len(d.TemplateFiles) == 0 {
+		return nil, errors.New("template file(s) not specified")
+	}
+
+	var tpl, textTpl Executer
+	var err error
+	switch d.MailFormat {
+	case HtmlFormat:
+		tpl, err = parseHtmlTemplates(d, loc, funcs...)
+		if err == nil {
+			textTpl, err = parseAltTextTemplates(d, loc, funcs...)
+		}
+	case PlainFormat, MarkdownFormat:
+		tpl, err = parseTextTemplates(d, loc, funcs...)
+	default:
+		err = fmt.Errorf("unknown mail format: %s", d.MailFormat)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sel, err := newTemplateSelector(d, tpl, textTpl)
+	if err != nil {
+		return nil, err
+	}
+	// subject and header templates use functions of the locale as well
+	localeFuncs := append([]map[string]any{loc.funcMap()}, funcs...)
+	if sel.headers, err = newHeaderTemplates(d, localeFuncs...); err != nil {
+		return nil, err
+	}
+	// markdown layout is rendered with functions and layout file of the locale
+	if d.MailFormat == MarkdownFormat {
+		if sel.markdown, err = newMarkdownRenderer(d, loc, funcs...); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+// localeSelector returns template selector matching language of the row,
+// templates of default locale are used if there is no match.
+func (m *Mailer) localeSelector(datum MailData) *templateSelector {
+	field := m.conf.Delivery.LanguageDataField
+	if len(m.selectors) == 1 || field == "" {
+		return m.selectors[0]
+	}
+	tag, err := language.Parse(strings.TrimSpace(datum.StringDefault(field, "")))
+	if err != nil {
+		return m.selectors[0]
+	}
+	_, idx, confidence := m.matcher.Match(tag)
+	if confidence == language.No {
+		return m.selectors[0]
+	}
+	return m.selectors[idx]
+}
+
 func (m *Mailer) readLines(filename string, fn func(string) string) ([]string, error) {
 	fd, err := os.Open(filename)
 	if err != nil {
@@ -151,32 +340,55 @@ func (m *Mailer) readLines(filename string, fn func(string) string) ([]string, e
 	return lines, nil
 }
 
+// readSentList reads sent addresses and hashes from journal.
+// Existing plain sent file is imported once if journal does not exist.
 func (m *Mailer) readSentList() error {
-	/*
-		fd, err := os.Open(m.conf.Delivery.SentFile)
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				return nil
-			}
-			return fmt.Errorf("open file %s error: %w", m.conf.Delivery.SentFile, err)
-		}
-		defer fd.Close()
-
-		scan := bufio.NewScanner(fd)
-		for scan.Scan() {
-			addr := strings.TrimSpace(scan.Text())
-			if addr != "" {
-				m.sentList = append(m.sentList, strings.ToLower(addr))
+	d := m.conf.Delivery
+	if _, err := os.Stat(d.JournalFile); errors.Is(err, os.ErrNotExist) && d.JournalFile != "" && d.SentFile != "" {
+		if _, err := os.Stat(d.SentFile); err == nil {
+			n, err := ImportSentFile(d.SentFile, d.JournalFile)
+			if err != nil {
+				return err
 			}
+			m.ui.Logf("Imported %d address(es) from %s into journal %s\n", n, d.SentFile, d.JournalFile)
 		}
-	*/
+	}
 
-	var err error
-	m.sentList, err = m.readLines(m.conf.Delivery.SentFile, strings.ToLower)
+	entries, err := ReadJournal(d.JournalFile)
 	if err != nil {
 		return err
 	}
+	m.sentList, m.hashList, m.rejectList = nil, nil, nil
+	rejected := []string{}
+	for _, e := range entries {
+		if !e.Delivered() && !e.Rejected() {
+			continue
+		}
+		for _, addr := range e.To {
+			if list, err := ParseAddressList(addr); err == nil {
+				for _, a := range list {
+					if e.Rejected() {
+						rejected = append(rejected, strings.ToLower(a.Address))
+					} else {
+						m.sentList = append(m.sentList, strings.ToLower(a.Address))
+					}
+				}
+			}
+		}
+		if e.Hash != "" && e.Delivered() {
+			m.hashList = append(m.hashList, e.Hash)
+		}
+	}
 	sort.Strings(m.sentList)
+	sort.Strings(m.hashList)
+
+	// rejected addresses which are not delivered later
+	for _, addr := range rejected {
+		if !m.mailSent(addr) {
+			m.rejectList = append(m.rejectList, addr)
+		}
+	}
+	sort.Strings(m.rejectList)
 
 	// log if verbose mode
 	if m.conf.Verbose {
@@ -204,12 +416,17 @@ func (m *Mailer) readSentList() error {
 	return nil
 }
 
-func (m *Mailer) mailSent(addr string) bool {
+func (m *Mailer) mailResend(addr string) bool {
 	addr = strings.ToLower(strings.TrimSpace(addr))
 	_, resend := sort.Find(len(m.resendList), func(i int) int {
 		return strings.Compare(addr, m.resendList[i])
 	})
-	if resend {
+	return resend
+}
+
+func (m *Mailer) mailSent(addr string) bool {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	if m.mailResend(addr) {
 		// force resend email
 		return false
 	}
@@ -222,67 +439,367 @@ func (m *Mailer) mailSent(addr string) bool {
 	return sent
 }
 
-func (m *Mailer) Send(ctx context.Context) (Stats, error) {
-	st := Stats{
-		Total: len(m.data.Data),
+// mailRejected checks whether address has been rejected permanently,
+// such address is not sent again unless listed in resend file
+func (m *Mailer) mailRejected(addr string) bool {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	if m.mailResend(addr) {
+		return false
 	}
-	// ensure connection keep alive
-	m.server.KeepAlive = true
+	_, rejected := sort.Find(len(m.rejectList), func(i int) int {
+		return strings.Compare(addr, m.rejectList[i])
+	})
+	return rejected
+}
+
+// hashSent check whether message with the same content hash has been sent
+func (m *Mailer) hashSent(hash string) bool {
+	_, sent := sort.Find(len(m.hashList), func(i int) int {
+		return strings.Compare(hash, m.hashList[i])
+	})
+	return sent
+}
 
-	// open connection
-	conn, err := m.server.Connect()
+// CheckAttachments verifies attachments of every row exist, are readable
+// and within size limit. All problems are reported in one error.
+func (m *Mailer) CheckAttachments(ctx context.Context) error {
+	src, err := OpenRowSource(m.conf)
 	if err != nil {
-		return st, fmt.Errorf("connect to smtp server error: %w", err)
+		return err
+	}
+	defer src.Close()
+
+	var problems []string
+	for row := 1; ; row++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		datum, err := src.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read data error: %w", err)
+		}
+
+		// rows which will be skipped are not checked
+		if m.schema.Apply(datum) != nil || !datum.HasFields(m.conf.Delivery.RequiredFields) {
+			continue
+		}
+		if _, err := m.attach.Resolve(datum); err != nil {
+			problems = append(problems, fmt.Sprintf("row #%d: %v", row, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("attachment check failed, %d row(s) with problem:\n  %s",
+			len(problems), strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func (m *Mailer) Send(ctx context.Context) (Stats, error) {
+	if err := m.parseTemplates(); err != nil {
+		return Stats{}, err
 	}
-	defer conn.Close()
 
-	// load send list
-	fd, err := os.OpenFile(m.conf.Delivery.SentFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	// optional pre-flight check before the first message is sent,
+	// it reads and renders all rows once more
+	if m.conf.Delivery.PreflightCheck {
+		report, err := m.Validate(ctx)
+		if err != nil {
+			return Stats{}, err
+		}
+		if err := report.Err(); err != nil {
+			return Stats{}, err
+		}
+	} else if !m.conf.Delivery.SkipAttachmentCheck {
+		// attachments of all rows are checked without rendering
+		if err := m.CheckAttachments(ctx); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	// open data, rows are read lazily while sending
+	src, err := OpenRowSource(m.conf)
 	if err != nil {
-		return st, fmt.Errorf("error opening sent file %s: %w", m.conf.Delivery.SentFile, err)
+		return Stats{}, err
+	}
+	defer src.Close()
+
+	// output of workers must not interleave
+	ui := m.ui
+	m.ui = &lockedUi{ui: ui}
+	defer func() { m.ui = ui }()
+
+	workers := m.conf.Delivery.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	var tr Transport
+	if m.conf.Delivery.PreviewMode {
+		// render to disk, smtp server is not used
+		if err := os.MkdirAll(m.conf.Delivery.PreviewDir, 0755); err != nil {
+			return Stats{}, fmt.Errorf("create preview directory %s error: %w", m.conf.Delivery.PreviewDir, err)
+		}
+	} else {
+		// transport set by caller is not closed
+		tr = m.transport
+		if tr == nil {
+			if tr, err = m.openTransport(workers); err != nil {
+				return Stats{}, err
+			}
+			defer tr.Close()
+		}
+
+		// open delivery journal
+		m.journal, err = OpenJournal(m.conf.Delivery.JournalFile)
+		if err != nil {
+			return Stats{}, err
+		}
+		defer m.journal.Close()
+	}
+
+	st := sendStats{}
+	pool := newSenderPool(ctx, m, tr, workers, &st)
+	err = m.produce(pool.ctx, src, pool, &st)
+	pool.close()
+	if perr := pool.err(); perr != nil {
+		err = perr
+	}
+
+	return st.get(), err
+}
+
+// produce reads and renders rows, prepared messages are sent by pool
+func (m *Mailer) produce(ctx context.Context, src RowSource, pool *senderPool, st *sendStats) error {
+	total := src.Total()
+	if total >= 0 {
+		st.update(func(s *Stats) { s.Total = total })
 	}
-	defer fd.Close()
-	m.sentWr = fd
 
 	// loop through message and send email
-	for _, datum := range m.data.Data {
-		if !datum.HasFields(m.conf.Delivery.RequiredFields) {
+	for row := 1; ; row++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		datum, err := src.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read data error: %w", err)
+		}
+		if total < 0 {
+			// count as it goes
+			st.update(func(s *Stats) { s.Total++ })
+		}
+
+		if err := m.schema.Apply(datum); err != nil {
+			m.ui.Logf("[WARN] Skip row #%d, invalid data: %v\n", row, err)
+			st.update(func(s *Stats) { s.NumSkip++ })
+			continue
+		}
+		if missing := datum.MissingFields(m.conf.Delivery.RequiredFields); len(missing) > 0 {
 			js, _ := json.Marshal(datum)
-			m.ui.Logf("[WARN] Skip DATUM>> %s\n", string(js))
-			st.NumSkip++
+			m.ui.Logf("[WARN] Skip row #%d, empty required field(s) %s>> %s\n", row, strings.Join(missing, ", "), string(js))
+			st.update(func(s *Stats) { s.NumSkip++ })
 			continue
 		}
-		var sb strings.Builder
-		if err := m.tpl.Execute(&sb, datum); err != nil {
+		sel, err := m.localeSelector(datum).Select(datum, datum.StringDefault(m.conf.Delivery.ToDataField, ""))
+		if err != nil {
+			m.ui.Logf("[WARN] Skip row #%d: %v\n", row, err)
+			st.update(func(s *Stats) { s.NumSkip++ })
+			continue
+		}
+		mc, err := m.render(datum, sel)
+		if err != nil {
 			js, _ := json.Marshal(datum)
 			m.ui.Logf("[WARN] DATUM>> %s\n", string(js))
-			st.NumError++
-			return st, err
+			st.update(func(s *Stats) { s.NumError++ })
+			return err
 		}
 
-		// send each mail
-		action, err := m.sendMail(ctx, conn, datum, sb.String(), &st)
-		if err != nil && action != ActContinueError {
-			return st, err
+		// build message of the row
+		dv, err := m.prepare(row, datum, mc, st)
+		if err != nil {
+			m.ui.Logf("Error when sending email: %v\n", err)
+			continue
+		}
+		if dv == nil {
+			continue
 		}
 
-		// Check action/message
-		switch action {
-		case ActAbortSend:
-			return st, errors.New("aborted by user")
-		case ActContinueError:
+		// Ask for confirmation, after previous messages are sent
+		if !m.conf.Delivery.PreviewMode && !m.conf.Delivery.SkipConfirmBeforeSend {
+			pool.drain()
+			action, err := m.confirm(dv.dest)
 			if err != nil {
-				m.ui.Logf("Error when sending email: %v\n", err)
+				return err
 			}
-		case ActDontSend:
-			m.ui.Logf("Skip send by user\n")
+			switch action {
+			case ActAbortSend:
+				return errors.New("aborted by user")
+			case ActDontSend:
+				m.ui.Logf("Skip send by user\n")
+				continue
+			}
+		}
+
+		// PDF is kept only for message which is sent
+		if err := m.savePdfs(mc); err != nil {
+			st.update(func(s *Stats) { s.NumError++ })
+			return err
 		}
+		pool.submit(dv)
 	}
 
-	return st, nil
+	return nil
+}
+
+// mailContent stores rendered message body of a row
+type mailContent struct {
+	// body in HTML or plain text according to mail format
+	body string
+	// plain text alternative of HTML body
+	text string
+	// files added by template functions and images embedded in HTML body
+	files []*AttachmentFile
+	// selected template or A/B variant
+	variant string
+	// subject and header templates of the locale
+	headers *headerTemplates
+	// generated PDF of each generator, also included in files
+	pdfs []*AttachmentFile
 }
 
-func (m *Mailer) sendMail(ctx context.Context, conn *mail.SMTPClient, datum MailData, body string, st *Stats) (int, error) {
+// render executes selected templates for the row
+func (m *Mailer) render(datum MailData, sel *selection) (*mailContent, error) {
+	d := m.conf.Delivery
+	m.funcs.begin(datum.StringDefault(d.KeyDataField, datum.StringDefault(d.ToDataField, "")))
+	defer m.funcs.end()
+
+	var sb strings.Builder
+	if err := sel.tpl.Execute(&sb, datum); err != nil {
+		return nil, err
+	}
+	mc := mailContent{body: sb.String(), variant: sel.variant, headers: sel.headers}
+	switch {
+	case d.MailFormat == PlainFormat:
+		if err := m.generatePdfs(datum, &mc); err != nil {
+			return nil, err
+		}
+		mc.files = append(m.funcs.end(), mc.pdfs...)
+		return &mc, nil
+	case sel.markdown != nil:
+		// markdown source is the text alternative
+		var err error
+		mc.text = mc.body
+		mc.body, err = sel.markdown.Render(mc.text, datum)
+		if err != nil {
+			return nil, err
+		}
+	case sel.textTpl != nil:
+		sb.Reset()
+		if err := sel.textTpl.Execute(&sb, datum); err != nil {
+			return nil, err
+		}
+		mc.text = sb.String()
+	case d.AutoText:
+		text, err := HtmlToText(mc.body)
+		if err != nil {
+			return nil, err
+		}
+		mc.text = text
+	}
+
+	// functions of PDF templates run while the row is rendered
+	if err := m.generatePdfs(datum, &mc); err != nil {
+		return nil, err
+	}
+	mc.files = m.funcs.end()
+
+	if m.html != nil {
+		body, images, err := m.html.Process(mc.body)
+		if err != nil {
+			return nil, err
+		}
+		mc.body = body
+		mc.files = append(mc.files, images...)
+	}
+	mc.files = append(mc.files, mc.pdfs...)
+	return &mc, nil
+}
+
+// generatePdfs generates PDF of the row, images created by template
+// functions of PDF template are embedded in the document
+func (m *Mailer) generatePdfs(datum MailData, mc *mailContent) error {
+	for _, g := range m.pdfs {
+		af, err := g.Generate(datum, m.funcs.image)
+		if err != nil {
+			return err
+		}
+		mc.pdfs = append(mc.pdfs, af)
+	}
+	return nil
+}
+
+// savePdfs writes generated PDF of the row to configured directories
+func (m *Mailer) savePdfs(mc *mailContent) error {
+	for i, af := range mc.pdfs {
+		if err := m.pdfs[i].save(af); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rowAddresses returns CC/BCC list of a row merged with (or replacing) global list
+func (m *Mailer) rowAddresses(datum MailData, field string, global []*netmail.Address) ([]*netmail.Address, error) {
+	list, err := datum.AddressField(field)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return global, nil
+	}
+	if strings.EqualFold(m.conf.Delivery.AddressPolicy, PolicyReplace) {
+		return list, nil
+	}
+	return append(append([]*netmail.Address{}, global...), list...), nil
+}
+
+// singleAddress returns address in field or default value if empty
+func singleAddress(datum MailData, field, def string) (string, error) {
+	list, err := datum.AddressField(field)
+	if err != nil {
+		return "", err
+	}
+	switch len(list) {
+	case 0:
+		return def, nil
+	case 1:
+		return list[0].String(), nil
+	}
+	return "", fmt.Errorf("field `%s` must contain single address, found %d", field, len(list))
+}
+
+// delivery is a prepared message of a row, sent by worker of the pool
+type delivery struct {
+	row     int
+	msg     *mail.Email
+	message *Message
+	entry   JournalEntry
+	dest    string
+	toList  []*netmail.Address
+	toCount int
+	variant string
+	// addresses of all recipients, used by rate limiter
+	recipients []string
+}
+
+// prepare builds message of the row. Nil delivery is returned if there is
+// nothing to send, e.g. all recipients already received the message.
+func (m *Mailer) prepare(row int, datum MailData, mc *mailContent, st *sendStats) (*delivery, error) {
 	c := m.conf
 	msg := mail.NewMSG()
 
@@ -290,104 +807,289 @@ func (m *Mailer) sendMail(ctx context.Context, conn *mail.SMTPClient, datum Mail
 	toField := c.Delivery.ToDataField
 	toVals := datum.StringDefault(toField, "")
 	if toVals == "" {
-		return ActContinueError, fmt.Errorf("destination address not found/field `%s` is empty", toField)
+		return nil, fmt.Errorf("destination address not found/field `%s` is empty", toField)
 	}
 	toList, err := ParseAddressList(toVals)
 	if err != nil {
-		return ActContinueError, fmt.Errorf("parse address `%s` error: %w", toVals, err)
+		return nil, fmt.Errorf("parse address `%s` error: %w", toVals, err)
+	}
+
+	// per row cc/bcc, reply-to, from and sender
+	ccList, err := m.rowAddresses(datum, c.Delivery.CcDataField, m.ccList)
+	if err != nil {
+		return nil, err
+	}
+	bccList, err := m.rowAddresses(datum, c.Delivery.BccDataField, m.bccList)
+	if err != nil {
+		return nil, err
+	}
+	// subject, from name, reply-to and custom headers
+	mh, err := mc.headers.render(datum, c.Delivery.SubjectDataField)
+	if err != nil {
+		return nil, fmt.Errorf("row #%d: %w", row, err)
+	}
+	from, err := singleAddress(datum, c.Delivery.FromDataField, c.Delivery.From)
+	if err != nil {
+		return nil, err
+	}
+	if from, err = withName(from, mh.fromName); err != nil {
+		return nil, err
+	}
+	sender, err := singleAddress(datum, c.Delivery.SenderDataField, "")
+	if err != nil {
+		return nil, err
+	}
+	replyTo, err := singleAddress(datum, c.Delivery.ReplyToDataField, mh.replyTo)
+	if err != nil {
+		return nil, err
 	}
 
 	// setup body
-	if c.Delivery.MailFormat == HtmlFormat {
-		msg.SetBody(mail.TextHTML, body)
+	if c.Delivery.MailFormat != PlainFormat {
+		// text alternative is added before html, preferred part comes last
+		if mc.text != "" {
+			msg.SetBody(mail.TextPlain, mc.text)
+			msg.AddAlternative(mail.TextHTML, mc.body)
+		} else {
+			msg.SetBody(mail.TextHTML, mc.body)
+		}
 	} else {
-		msg.SetBody(mail.TextPlain, body)
+		msg.SetBody(mail.TextPlain, mc.body)
 	}
 
 	// setup attachments
-	files := datum.AttachmentFiles()
+	files, err := m.attach.Resolve(datum)
+	if err != nil {
+		return nil, fmt.Errorf("attachment error: %w", err)
+	}
+	files = append(files, mc.files...)
 	for _, af := range files {
 		fi := mail.File{
 			FilePath: af.FilePath,
 			Name:     af.Name,
+			Data:     af.Data,
 			Inline:   af.Inline,
 		}
 		msg.Attach(&fi)
 	}
 
-	// setup subject field
-	subjectField := c.Delivery.SubjectDataField
-	subject := datum.StringDefault(subjectField, c.Delivery.DefaultSubject)
+	// setup subject and custom headers
+	subject := mh.subject
 	msg.SetSubject(subject)
+	for _, hdr := range mh.headers {
+		msg.AddHeader(hdr[0], hdr[1])
+	}
 
 	// setup from
-	msg.SetFrom(c.Delivery.From)
+	msg.SetFrom(from)
+	if sender != "" {
+		msg.SetSender(sender)
+	}
+	if replyTo != "" {
+		msg.SetReplyTo(replyTo)
+	}
 
 	// set destination
-	dest := ""
-	toCount := 0
-	var sbSent strings.Builder
-	if c.Delivery.SendMode {
+	dv := delivery{
+		row:     row,
+		msg:     msg,
+		toList:  toList,
+		variant: mc.variant,
+		entry: JournalEntry{
+			Row:     row,
+			Key:     datum.StringDefault(c.Delivery.KeyDataField, toVals),
+			Subject: subject,
+			Variant: mc.variant,
+		},
+	}
+	if c.Delivery.SendMode || c.Delivery.PreviewMode {
+		byHash := strings.EqualFold(c.Delivery.DuplicateCheck, DuplicateByHash)
+		resend := false
+		added := map[string]bool{}
+		recipients := []string{}
 		for _, to := range toList {
-			if c.Delivery.SkipIfSent && m.mailSent(to.Address) {
+			resend = resend || m.mailResend(to.Address)
+			if c.Delivery.SkipIfSent && !byHash && m.mailSent(to.Address) {
 				// skip already send email
 				m.ui.Logf("Skipping address: %s, email already sent\n", to.Address)
-				st.NumAlreadySent++
+				st.update(func(s *Stats) { s.NumAlreadySent++ })
 				continue
 			}
-			fmt.Fprintln(&sbSent, to.Address)
-			toCount++
+			if c.Delivery.SendMode && m.mailRejected(to.Address) {
+				m.ui.Logf("Skipping address: %s, previously rejected permanently\n", to.Address)
+				st.update(func(s *Stats) { s.NumSkip++ })
+				continue
+			}
+			if added[strings.ToLower(to.Address)] {
+				continue
+			}
+			added[strings.ToLower(to.Address)] = true
+			recipients = append(recipients, to.Address)
+			dv.entry.To = append(dv.entry.To, to.String())
+			dv.toCount++
 
 			msg.AddTo(to.String())
-			if dest != "" {
-				dest += ","
+			if dv.dest != "" {
+				dv.dest += ","
+			}
+			dv.dest += to.String()
+		}
+		for _, cc := range ccList {
+			if !added[strings.ToLower(cc.Address)] {
+				added[strings.ToLower(cc.Address)] = true
+				recipients = append(recipients, cc.Address)
+				dv.entry.Cc = append(dv.entry.Cc, cc.String())
+				msg.AddCc(cc.String())
+			}
+		}
+		for _, bcc := range bccList {
+			if !added[strings.ToLower(bcc.Address)] {
+				added[strings.ToLower(bcc.Address)] = true
+				recipients = append(recipients, bcc.Address)
+				dv.entry.Bcc = append(dv.entry.Bcc, bcc.String())
+				msg.AddBcc(bcc.String())
 			}
-			dest += to.String()
 		}
-		for _, cc := range m.ccList {
-			msg.AddCc(cc)
+		if dv.toCount == 0 {
+			return nil, nil
 		}
-		for _, bcc := range m.bccList {
-			msg.AddBcc(bcc)
+		dv.recipients = recipients
+
+		// content hash of the message
+		dv.entry.Hash, err = MessageHash(c.Delivery.HashParts, &HashInput{
+			Recipients: recipients,
+			Subject:    subject,
+			Body:       mc.body + mc.text,
+			Files:      files,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("compute hash of message to %s error: %w", dv.dest, err)
 		}
-		if toCount == 0 {
-			return ActSend, nil
+		if c.Delivery.SkipIfSent && byHash && !resend && m.hashSent(dv.entry.Hash) {
+			m.ui.Logf("Skipping message to: %s, identical message already sent\n", dv.dest)
+			st.update(func(s *Stats) { s.NumAlreadySent += dv.toCount })
+			return nil, nil
 		}
 	} else {
 		// Test address
-		dest = c.Delivery.TestAddress
+		dv.dest = c.Delivery.TestAddress
+		dv.recipients = []string{c.Delivery.TestAddress}
 		msg.AddTo(c.Delivery.TestAddress)
 	}
 
-	// Ask for confirmation
-	if !c.Delivery.SkipConfirmBeforeSend {
-		str := fmt.Sprintf("Send email to %s [(Y)es/(N)o/Yes to (A)ll/(C)ancel]? ", dest)
-		action, err := m.ui.Confirm(str)
-		if err != nil {
-			return action, fmt.Errorf("user confirmation error %w", err)
-		}
-		if action == ActSendAll {
-			m.ui.Logf("Skip further confirmation\n")
-			m.conf.Delivery.SkipConfirmBeforeSend = true
-		}
+	dv.entry.MessageID = newMessageID(from)
+	msg.AddHeader("Message-ID", dv.entry.MessageID)
+	if err := msg.GetError(); err != nil {
+		return nil, fmt.Errorf("build message to %s error: %w", dv.dest, err)
+	}
+
+	// message passed to transport
+	fromAddr, err := netmail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("parse from address `%s` error: %w", from, err)
+	}
+	dv.message = &Message{
+		EnvelopeFrom: fromAddr.Address,
+		Recipients:   msg.GetRecipients(),
+		Raw:          []byte(msg.GetMessage()),
+		MessageID:    dv.entry.MessageID,
+		From:         fromAddr.String(),
+		Sender:       sender,
+		ReplyTo:      replyTo,
+		To:           dv.entry.To,
+		Cc:           dv.entry.Cc,
+		Bcc:          dv.entry.Bcc,
+		Subject:      subject,
+		Headers:      map[string]string{},
+		Html:         mc.body,
+		Text:         mc.text,
+		Attachments:  files,
+	}
+	if c.Delivery.MailFormat == PlainFormat {
+		dv.message.Html, dv.message.Text = "", mc.body
+	}
+	if !c.Delivery.SendMode && !c.Delivery.PreviewMode {
+		dv.message.To = []string{c.Delivery.TestAddress}
+	}
+	for _, hdr := range mh.headers {
+		dv.message.Headers[hdr[0]] = hdr[1]
+	}
+
+	return &dv, nil
+}
 
-		// check testing
-		if action != ActSend && action != ActSendAll {
-			return action, nil
+// confirm asks user whether message to dest is sent
+func (m *Mailer) confirm(dest string) (int, error) {
+	str := fmt.Sprintf("Send email to %s [(Y)es/(N)o/Yes to (A)ll/(C)ancel]? ", dest)
+	action, err := m.ui.Confirm(str)
+	if err != nil {
+		return action, fmt.Errorf("user confirmation error %w", err)
+	}
+	if action == ActSendAll {
+		m.ui.Logf("Skip further confirmation\n")
+		m.conf.Delivery.SkipConfirmBeforeSend = true
+	}
+	return action, nil
+}
+
+// deliver sends prepared message through transport,
+// or writes it to preview directory
+func (m *Mailer) deliver(ctx context.Context, tr Transport, dv *delivery, st *sendStats) error {
+	c := m.conf
+
+	// write message to preview directory
+	if c.Delivery.PreviewMode {
+		filename, err := writePreview(c.Delivery.PreviewDir, dv.row, dv.toList, dv.msg)
+		if err != nil {
+			st.update(func(s *Stats) { s.NumError++ })
+			return err
 		}
+		m.ui.Logf("Written email to %s: %s\n", dv.dest, filename)
+		st.update(func(s *Stats) { s.sent(dv.toCount, dv.variant) })
+		return nil
 	}
 
-	if m.intBetween > 0 {
-		time.Sleep(m.intBetween)
+	// message is not attempted if rate limit is not satisfied
+	if err := m.limiter.Wait(ctx, dv.recipients); err != nil {
+		st.update(func(s *Stats) { s.NumUnsent++ })
+		return fmt.Errorf("not sending email to %s: %w", dv.dest, err)
+	}
+	res, attempts, err := m.sendWithRetry(ctx, tr, dv, st)
+	if errors.Is(err, ErrNoServer) {
+		st.update(func(s *Stats) { s.NumUnsent++ })
+		return fmt.Errorf("not sending email to %s: %w", dv.dest, err)
 	}
-	if err := msg.Send(conn); err != nil {
-		st.NumError++
-		return ActContinueError, fmt.Errorf("sending email to %s error: %w", dest, err)
+	entry := dv.entry
+	entry.Time = time.Now()
+	entry.Attempts = attempts
+	if res != nil {
+		entry.Server = res.Server
+	}
+	if err != nil {
+		entry.SetError(err)
+		st.update(func(s *Stats) {
+			s.NumError++
+			if entry.Rejected() {
+				s.NumRejected++
+			}
+		})
+		if c.Delivery.SendMode {
+			if jerr := m.journal.Write(&entry); jerr != nil {
+				m.ui.Logf("[WARN] %v\n", jerr)
+			}
+		}
+		return fmt.Errorf("sending email to %s error: %w", dv.dest, err)
+	}
+	m.ui.Logf("Sent email to: %s\n", dv.dest)
+	st.update(func(s *Stats) { s.sent(dv.toCount, dv.variant) })
+	if c.Delivery.SendMode {
+		entry.Code = res.Code
+		entry.Reply = res.Reply
+		entry.Outcome = OutcomeSent
+		if err := m.journal.Write(&entry); err != nil {
+			return err
+		}
 	}
-	m.ui.Logf("Sent email to: %s\n", dest)
-	fmt.Fprint(m.sentWr, sbSent.String())
-	st.NumSentAddr += toCount
-	st.NumSentData++
 
-	return ActContinueError, msg.GetError()
+	return nil
 }
@@ -0,0 +1,699 @@
+package sendme_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipsusila/sendme"
+	"github.com/stretchr/testify/assert"
+)
+
+// previewConfig creates configuration rendering messages to preview directory
+func previewConfig(t *testing.T, data, tpl string) *sendme.Config {
+	dir := t.TempDir()
+	dataFile := filepath.Join(dir, "list.csv")
+	tplFile := filepath.Join(dir, "mail.tpl")
+	assert.NoError(t, os.WriteFile(dataFile, []byte(data), 0644))
+	assert.NoError(t, os.WriteFile(tplFile, []byte(tpl), 0644))
+
+	conf := sendme.DefaultConfig()
+	d := conf.Delivery
+	d.From = "Organizer <organizer@example.com>"
+	d.MailFormat = sendme.PlainFormat
+	d.TemplateFiles = []string{tplFile}
+	d.TemplateName = "mail.tpl"
+	d.DataFile = dataFile
+	d.ToDataField = "Email"
+	d.JournalFile = filepath.Join(dir, "journal.jsonl")
+	d.SentFile = ""
+	d.PreviewMode = true
+	d.PreviewDir = filepath.Join(dir, "preview")
+	return conf
+}
+
+// sendConfig creates configuration delivering messages through transport
+func sendConfig(t *testing.T, data, tpl string) *sendme.Config {
+	conf := previewConfig(t, data, tpl)
+	d := conf.Delivery
+	d.PreviewMode = false
+	d.SendMode = true
+	d.IntervalBetweenSend = "0s"
+	return conf
+}
+
+// readEml reads preview file, quoted-printable body is decoded
+func readEml(t *testing.T, filename string) string {
+	fd, err := os.Open(filename)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer fd.Close()
+	content, err := io.ReadAll(quotedprintable.NewReader(fd))
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestPreview(t *testing.T) {
+	conf := previewConfig(t,
+		"Name,Email,Manager\nAlice,alice@example.com,am@example.com\nBob,bob@example.com,\n",
+		"Dear {{.Name}}")
+	conf.Delivery.CcDataField = "Manager"
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+	assert.Equal(t, 2, st.Total)
+
+	files, err := filepath.Glob(filepath.Join(conf.Delivery.PreviewDir, "*.eml"))
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		assert.Equal(t, "00001_alice@example.com.eml", filepath.Base(files[0]))
+		content, err := os.ReadFile(files[0])
+		assert.NoError(t, err)
+		eml := string(content)
+		assert.Contains(t, eml, "Dear Alice")
+		assert.Contains(t, eml, "Cc: <am@example.com>")
+		assert.True(t, strings.Contains(eml, "Message-Id: <"))
+	}
+
+	// nothing is recorded in journal
+	_, err = os.Stat(conf.Delivery.JournalFile)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestAttachments(t *testing.T) {
+	conf := previewConfig(t,
+		"ID,Email,attachment_1,attachment_2\nC1,alice@example.com,invoices/{{.ID}}.pdf,docs/*.txt\nC2,bob@example.com,invoices/{{.ID}}.pdf,docs\n",
+		"Invoice {{.ID}}")
+	root := t.TempDir()
+	conf.Delivery.AttachmentRoot = root
+	conf.Delivery.MaxAttachmentSize = "1KB"
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "invoices"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "docs"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "invoices", "C1.pdf"), []byte("%PDF C1"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "docs", "terms.txt"), []byte("terms"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "docs", "faq.txt"), []byte("faq"), 0644))
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// invoice of C2 is missing, nothing is written
+	_, err = mailer.Send(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "row #2")
+		assert.Contains(t, err.Error(), "attachment_1")
+	}
+	_, err = os.Stat(conf.Delivery.PreviewDir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// too large file
+	large := make([]byte, 2048)
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "invoices", "C2.pdf"), large, 0644))
+	err = mailer.CheckAttachments(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "exceeds limit")
+	}
+
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "invoices", "C2.pdf"), []byte("%PDF C2"), 0644))
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+
+	content, err := os.ReadFile(filepath.Join(conf.Delivery.PreviewDir, "00001_alice@example.com.eml"))
+	assert.NoError(t, err)
+	for _, name := range []string{"C1.pdf", "faq.txt", "terms.txt"} {
+		assert.Contains(t, string(content), `filename="`+name+`"`)
+	}
+}
+
+func TestAlternativeText(t *testing.T) {
+	conf := previewConfig(t,
+		"Name,Email\nAlice,alice@example.com\n",
+		`<p>Dear <b>{{.Name}}</b>, see <a href="https://example.com">site</a></p>`)
+	conf.Delivery.MailFormat = sendme.HtmlFormat
+	conf.Delivery.AutoText = true
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(conf.Delivery.PreviewDir, "00001_alice@example.com.eml"))
+	assert.NoError(t, err)
+	eml := string(content)
+	assert.Contains(t, eml, "multipart/alternative")
+	assert.Contains(t, eml, "Content-Type: text/plain")
+	assert.Contains(t, eml, "Content-Type: text/html")
+	assert.Contains(t, eml, "[1] https://example.com")
+}
+
+func TestHeaderTemplates(t *testing.T) {
+	conf := previewConfig(t,
+		"Name,Email,Manager,Campaign\nAlice,alice@example.com,am@example.com,Q3\nBob,bob@example.com,am@example.com,Q3\n",
+		"Dear {{.Name}}")
+	d := conf.Delivery
+	d.DefaultSubject = `Invoice for {{.Name}}{{if eq .Name "Bob"}}{{fail "no invoice"}}{{end}}`
+	d.FromName = "{{.Name}}'s Account Manager"
+	d.ReplyTo = "{{.Manager}}"
+	d.Headers = map[string]string{
+		"X-Campaign":       "{{.Campaign}}",
+		"List-Unsubscribe": "<mailto:unsubscribe@example.com?subject={{.Email}}>",
+		"X-Empty":          "{{.Missing | default \"\"}}",
+	}
+	d.PreflightCheck = true
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// pre-flight check fails before anything is written
+	_, err = mailer.Send(context.Background())
+	assert.ErrorContains(t, err, "no invoice")
+	assert.NoDirExists(t, d.PreviewDir)
+
+	// without pre-flight, row #2 is reported and skipped
+	d.PreflightCheck = false
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, st.NumSentData)
+
+	content, err := os.ReadFile(filepath.Join(d.PreviewDir, "00001_alice@example.com.eml"))
+	assert.NoError(t, err)
+	eml := string(content)
+	assert.Contains(t, eml, "Subject: Invoice for Alice")
+	assert.Contains(t, eml, "From: \"Alice's Account Manager\" <organizer@example.com>")
+	assert.Contains(t, eml, "Reply-To: <am@example.com>")
+	assert.Contains(t, eml, "X-Campaign: Q3")
+	assert.Contains(t, eml, "List-Unsubscribe: <mailto:unsubscribe@example.com?subject=alice@example.com>")
+	assert.NotContains(t, eml, "X-Empty")
+
+	// invalid template in config, templates are parsed before sending
+	d.Headers = map[string]string{"X-Bad": "{{.Name"}
+	mailer, err = sendme.NewMailer(conf)
+	if assert.NoError(t, err) {
+		_, err = mailer.Send(context.Background())
+		assert.ErrorContains(t, err, "parse X-Bad template error")
+	}
+}
+
+func TestSubjectField(t *testing.T) {
+	conf := previewConfig(t, "Name,Email,Code,Subject\n"+
+		"Alice,alice@example.com,A-1,Invoice {{.Code}} for {{.Name | upper}}\n"+
+		"Bob,bob@example.com,B-2,\n", "Dear {{.Name}}")
+	d := conf.Delivery
+	d.SubjectDataField = "Subject"
+	d.DefaultSubject = "Welcome {{.Name}}"
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+
+	// subject column is executed with the same data and functions
+	eml := readEml(t, filepath.Join(d.PreviewDir, "00001_alice@example.com.eml"))
+	assert.Contains(t, eml, "Subject: Invoice A-1 for ALICE")
+	eml = readEml(t, filepath.Join(d.PreviewDir, "00002_bob@example.com.eml"))
+	assert.Contains(t, eml, "Subject: Welcome Bob")
+}
+
+func TestHtmlProcessing(t *testing.T) {
+	conf := previewConfig(t,
+		"Name,Email\nAlice,alice@example.com\n",
+		`<html><head><style>
+p { color: red; margin: 0 }
+.note { font-weight: bold }
+td > a { color: green }
+a:hover { color: blue }
+@media (max-width: 600px) { p { margin: 4px } }
+</style></head>
+<body>
+  <!-- greeting -->
+  <p class="note" style="margin: 2px">Dear   {{.Name}}</p>
+  <table><tr><td><a href="https://example.com">link</a></td></tr></table>
+  <img src="logo.png" alt="Logo"> <img src="logo.png"> <img src="https://example.com/x.png">
+</body></html>`)
+	d := conf.Delivery
+	d.MailFormat = sendme.HtmlFormat
+	d.InlineCss = true
+	d.EmbedImages = true
+	d.Minify = true
+	assert.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(d.TemplateFiles[0]), "logo.png"), []byte("PNG"), 0644))
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+
+	eml := readEml(t, filepath.Join(d.PreviewDir, "00001_alice@example.com.eml"))
+	assert.Contains(t, eml, `<p class="note" style="color: red; margin: 2px; font-weight: bold">Dear Alice</p>`)
+	assert.Contains(t, eml, `<a href="https://example.com" style="color: green">`)
+	assert.Contains(t, eml, `a:hover { color: blue }`)
+	assert.Contains(t, eml, `@media (max-width: 600px)`)
+	assert.NotContains(t, eml, "greeting")
+	assert.Contains(t, eml, `src="https://example.com/x.png"`)
+	assert.Equal(t, 2, strings.Count(eml, `src="cid:`))
+	assert.Equal(t, 1, strings.Count(eml, `filename="logo.png"`))
+	assert.Contains(t, eml, "multipart/related")
+}
+
+func TestMarkdown(t *testing.T) {
+	conf := previewConfig(t,
+		"Name,Email,Amount\nAlice,alice@example.com,100\n",
+		"# Hello {{.Name}}\n\n| Item | Amount |\n|------|--------|\n| Fee  | {{.Amount}} |\n\n- see [site](https://example.com)\n")
+	d := conf.Delivery
+	d.MailFormat = sendme.MarkdownFormat
+	d.MarkdownLayoutFile = filepath.Join(t.TempDir(), "layout.html")
+	assert.NoError(t, os.WriteFile(d.MarkdownLayoutFile,
+		[]byte(`<html><body><div class="wrap">{{.Body}}</div><p>To: {{.Data.Email}}</p></body></html>`), 0644))
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+
+	eml := readEml(t, filepath.Join(d.PreviewDir, "00001_alice@example.com.eml"))
+	assert.Contains(t, eml, "multipart/alternative")
+	assert.Contains(t, eml, "# Hello Alice")
+	assert.Contains(t, eml, `<div class="wrap"><h1>Hello Alice</h1>`)
+	assert.Contains(t, eml, "<td>100</td>")
+	assert.Contains(t, eml, `<li>see <a href="https://example.com">site</a></li>`)
+	assert.Contains(t, eml, "<p>To: alice@example.com</p>")
+}
+
+func TestMarkdownLocales(t *testing.T) {
+	conf := sendConfig(t,
+		"Name,Email,Lang,Amount\nBudi,budi@example.com,id,1500.5\nAlice,alice@example.com,en,1500.5\n", "")
+	d := conf.Delivery
+	dir := filepath.Dir(d.TemplateFiles[0])
+	writeFiles(t, dir, map[string]string{
+		"id/mail.md":     "# {{tr \"greeting\" .Name}}",
+		"en/mail.md":     "# {{tr \"greeting\" .Name}}",
+		"id/layout.html": `<html lang="{{locale}}"><body>{{.Body}}<p>Total {{formatNumber .Data.Amount 2}}</p><p>{{tr "footer"}}</p></body></html>`,
+		"en/layout.html": `<html lang="{{locale}}"><body>{{.Body}}<p>Amount {{formatNumber .Data.Amount 2}}</p><p>{{tr "footer"}}</p></body></html>`,
+		"catalog.yaml":   "en:\n  greeting: Dear %s\n  footer: Regards\nid:\n  greeting: Yth. %s\n  footer: Salam\n",
+	})
+	d.MailFormat = sendme.MarkdownFormat
+	d.TemplateFiles = []string{filepath.Join(dir, "{locale}", "mail.md")}
+	d.TemplateName = "mail.md"
+	d.MarkdownLayoutFile = filepath.Join(dir, "{locale}", "layout.html")
+	d.LanguageDataField = "Lang"
+	d.Locales = []string{"en", "id"}
+	d.DefaultLocale = "en"
+	d.CatalogFile = filepath.Join(dir, "catalog.yaml")
+
+	tr := recordTransport{}
+	_, err := tr.send(t, conf)
+	if !assert.NoError(t, err) || !assert.Len(t, tr.messages, 2) {
+		return
+	}
+	html := map[string]string{}
+	for _, msg := range tr.messages {
+		html[msg.Recipients[0]] = msg.Html
+	}
+	assert.Contains(t, html["budi@example.com"], `<html lang="id"><body><h1>Yth. Budi</h1>`)
+	assert.Contains(t, html["budi@example.com"], "<p>Total 1.500,50</p><p>Salam</p>")
+	assert.Contains(t, html["alice@example.com"], `<html lang="en"><body><h1>Dear Alice</h1>`)
+	assert.Contains(t, html["alice@example.com"], "<p>Amount 1,500.50</p><p>Regards</p>")
+}
+
+func TestVariants(t *testing.T) {
+	data := "Name,Email,Template\n"
+	for i := 0; i < 40; i++ {
+		data += fmt.Sprintf("User%d,user%d@example.com,\n", i, i)
+	}
+	data += "Vip,vip@example.com,vip.tpl\nBad,bad@example.com,missing.tpl\n"
+	conf := previewConfig(t, data, "Default {{.Name}}")
+	d := conf.Delivery
+	dir := filepath.Dir(d.TemplateFiles[0])
+	writeFiles(t, dir, map[string]string{
+		"a.tpl":   "Variant A {{.Name}}",
+		"b.tpl":   "Variant B {{.Name}}",
+		"vip.tpl": "VIP {{.Name}}",
+	})
+	d.TemplateFiles = []string{dir + "/*.tpl"}
+	d.TemplateDataField = "Template"
+	d.Variants = []*sendme.VariantConfig{
+		{Name: "A", Template: "a.tpl", Weight: 1},
+		{Name: "B", Template: "b.tpl", Weight: 3},
+	}
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, st.NumSkip)
+	assert.Equal(t, 41, st.NumSentData)
+	assert.Equal(t, 1, st.Variants["vip.tpl"])
+	assert.Equal(t, 40, st.Variants["A"]+st.Variants["B"])
+	assert.Greater(t, st.Variants["B"], st.Variants["A"])
+
+	eml := readEml(t, filepath.Join(d.PreviewDir, "00041_vip@example.com.eml"))
+	assert.Contains(t, eml, "VIP Vip")
+
+	// same address always gets the same variant
+	first := readEml(t, filepath.Join(d.PreviewDir, "00001_user0@example.com.eml"))
+	assert.NoError(t, os.RemoveAll(d.PreviewDir))
+	_, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+	second := readEml(t, filepath.Join(d.PreviewDir, "00001_user0@example.com.eml"))
+	assert.Equal(t, strings.Contains(first, "Variant A"), strings.Contains(second, "Variant A"))
+	assert.True(t, strings.Contains(first, "Variant A") || strings.Contains(first, "Variant B"))
+
+	d.Variants[0].Template = "c.tpl"
+	mailer, err = sendme.NewMailer(conf)
+	if assert.NoError(t, err) {
+		_, err = mailer.Send(context.Background())
+		assert.ErrorContains(t, err, "template `c.tpl` not found")
+	}
+}
+
+func TestVariantsLayout(t *testing.T) {
+	data := "Name,Email,Template\n"
+	for i := 0; i < 10; i++ {
+		data += fmt.Sprintf("User%d,user%d@example.com,\n", i, i)
+	}
+	data += "Vip,vip@example.com,vip.tpl\n"
+	conf := previewConfig(t, data, `{{define "content"}}Default{{end}}`)
+	d := conf.Delivery
+	dir := filepath.Dir(d.TemplateFiles[0])
+	writeFiles(t, dir, map[string]string{
+		"layout.tpl":        `[{{block "content" .}}none{{end}}|{{template "sign"}}]`,
+		"partials/sign.tpl": `{{define "sign"}}team{{end}}`,
+		"variants/a.tpl":    `{{define "content"}}A {{.Name}}{{end}}`,
+		"variants/b.tpl":    `{{define "content"}}B {{.Name}}{{end}}`,
+		"variants/vip.tpl":  `{{define "content"}}VIP {{.Name}}{{end}}{{define "sign"}}boss{{end}}`,
+	})
+	d.TemplateFiles = append(d.TemplateFiles, filepath.Join(dir, "variants"))
+	d.LayoutFile = filepath.Join(dir, "layout.tpl")
+	d.PartialPaths = []string{filepath.Join(dir, "partials")}
+	d.TemplateDataField = "Template"
+	d.Variants = []*sendme.VariantConfig{
+		{Name: "A", Template: "a.tpl", Weight: 1},
+		{Name: "B", Template: "b.tpl", Weight: 1},
+	}
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 11, st.NumSentData)
+	assert.Equal(t, 10, st.Variants["A"]+st.Variants["B"])
+	assert.Greater(t, st.Variants["A"], 0)
+	assert.Greater(t, st.Variants["B"], 0)
+
+	// every variant fills its own copy of layout
+	for i := 0; i < 10; i++ {
+		eml := readEml(t, filepath.Join(d.PreviewDir, fmt.Sprintf("%05d_user%d@example.com.eml", i+1, i)))
+		name := fmt.Sprintf("User%d|team]", i)
+		assert.True(t, strings.Contains(eml, "[A "+name) || strings.Contains(eml, "[B "+name), eml)
+	}
+	eml := readEml(t, filepath.Join(d.PreviewDir, "00011_vip@example.com.eml"))
+	assert.Contains(t, eml, "[VIP Vip|boss]")
+
+	// without selection, main templates share one set
+	d.TemplateDataField = ""
+	d.Variants = nil
+	_, err = sendme.NewMailer(conf)
+	if assert.NoError(t, err) {
+		_, err = sendme.ParseTextTemplates(conf)
+		assert.ErrorContains(t, err, "template `content` defined in both")
+	}
+}
+
+func TestLocales(t *testing.T) {
+	conf := previewConfig(t,
+		"Name,Email,Lang,Amount,Due\n"+
+			"Budi,budi@example.com,id,1500000.5,2023-08-17\n"+
+			"Alice,alice@example.com,en-US,1500000.5,2023-08-17\n"+
+			"Hans,hans@example.com,de,1500000.5,2023-08-17\n",
+		"")
+	d := conf.Delivery
+	dir := filepath.Dir(d.TemplateFiles[0])
+	writeFiles(t, dir, map[string]string{
+		"id/mail.tpl":  `{{tr "greeting" .Name}} {{formatCurrency "IDR" .Amount}} {{formatNumber .Amount 2}} {{formatDate "Monday, 2 January 2006" .Due}} {{tr "bye"}}`,
+		"en/mail.tpl":  `{{tr "greeting" .Name}} {{formatCurrency "IDR" .Amount}} {{formatNumber .Amount 2}} {{formatDate "Monday, 2 January 2006" .Due}} {{tr "bye"}}`,
+		"catalog.yaml": "en:\n  greeting: Dear %s,\n  bye: Regards\n  invoice: Invoice\nid:\n  greeting: Yth. %s,\n  invoice: Tagihan\n",
+	})
+	d.TemplateFiles = []string{filepath.Join(dir, "{locale}", "mail.tpl")}
+	d.LanguageDataField = "Lang"
+	d.Locales = []string{"id", "en"}
+	d.DefaultLocale = "en"
+	d.CatalogFile = filepath.Join(dir, "catalog.yaml")
+	// subject is rendered with functions of the row locale
+	d.DefaultSubject = `{{tr "invoice"}} {{formatNumber .Amount 2}} {{formatDate "2 January 2006" .Due}}`
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+
+	eml := readEml(t, filepath.Join(d.PreviewDir, "00001_budi@example.com.eml"))
+	assert.Contains(t, eml, "Yth. Budi, Rp 1.500.001 1.500.000,50 Kamis, 17 Agustus 2023 Regards")
+	assert.Contains(t, eml, "Subject: Tagihan 1.500.000,50 17 Agustus 2023")
+	eml = readEml(t, filepath.Join(d.PreviewDir, "00002_alice@example.com.eml"))
+	assert.Contains(t, eml, "Dear Alice, IDR 1,500,001 1,500,000.50 Thursday, 17 August 2023 Regards")
+	assert.Contains(t, eml, "Subject: Invoice 1,500,000.50 17 August 2023")
+	// fallback to default locale
+	eml = readEml(t, filepath.Join(d.PreviewDir, "00003_hans@example.com.eml"))
+	assert.Contains(t, eml, "Dear Hans,")
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	conf := previewConfig(t,
+		"Name,Email,Code,Amount,Branch\nAlice,alice@example.com,INV-001,1500000,JKT\n",
+		`<p>{{shout .Name}} {{formatRupiah .Amount}} {{(lookup .Lookup "code" .Branch).city}}</p>
+<img src="{{qrcode .Code}}"><img src="{{barcode .Code}}">
+<a href="{{trackingURL "https://example.com/pay"}}">pay</a>{{attachFile "terms.txt" "Terms.txt"}}`)
+	d := conf.Delivery
+	dir := filepath.Dir(d.TemplateFiles[0])
+	writeFiles(t, dir, map[string]string{
+		"terms.txt":    "terms and conditions",
+		"branches.csv": "code,city\nBDG,Bandung\nJKT,Jakarta\n",
+	})
+	d.MailFormat = sendme.HtmlFormat
+	d.AttachmentRoot = dir
+	d.TrackingURL = "https://t.example.com/click?campaign=q3"
+	d.TemplateFiles = []string{filepath.Join(dir, "mail.tpl")}
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, mailer.Funcs(map[string]any{"shout": strings.ToUpper}))
+	assert.Error(t, mailer.Funcs(map[string]any{"bad": 1}))
+
+	// lookup file is passed in data to keep the template independent of temp dir
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "list.csv"),
+		[]byte("Name,Email,Code,Amount,Branch,Lookup\nAlice,alice@example.com,INV-001,1500000,JKT,"+
+			filepath.Join(dir, "branches.csv")+"\n"), 0644))
+	_, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Error(t, mailer.Funcs(map[string]any{"late": strings.ToLower}))
+
+	eml := readEml(t, filepath.Join(d.PreviewDir, "00001_alice@example.com.eml"))
+	assert.Contains(t, eml, "<p>ALICE Rp 1.500.000 Jakarta</p>")
+	// content id is replaced by generated id of inline part
+	assert.Equal(t, 2, strings.Count(eml, `src="cid:`))
+	assert.Contains(t, eml, `filename="qrcode-1.png"`)
+	assert.Contains(t, eml, `filename="barcode-2.png"`)
+	assert.Contains(t, eml, "https://t.example.com/click?campaign=q3&amp;rcpt=alice%40example.com&amp;url=https%3A%2F%2Fexample.com%2Fpay")
+	assert.Contains(t, eml, `filename="Terms.txt"`)
+}
+
+func TestValidate(t *testing.T) {
+	conf := previewConfig(t,
+		"Name,Email,Manager,Notes,Code,attachment_1\n"+
+			"Alice,alice@example.com,am@example.com,n1,A1,\n"+
+			"Bob,bob@,,n2,B1,\n"+
+			",carol@example.com,,n3,C1,\n"+
+			"Dave,dave@example.com,,n4,,missing.pdf\n",
+		`Dear {{.Name}}{{if .Code}} code {{index . "Code"}}{{else}}{{.Title}}{{end}}`)
+	d := conf.Delivery
+	d.CcDataField = "Manager"
+	d.RequiredFields = []string{"Name"}
+	d.DefaultSubject = "Hello {{$.Name}}"
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	report, err := mailer.Validate(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 4, report.Total)
+	assert.Equal(t, 1, report.NumSkip())
+	assert.Equal(t, []string{"Notes"}, report.UnusedColumns)
+
+	kinds := map[int]string{}
+	for _, p := range report.Problems {
+		kinds[p.Row] += p.Kind + ";"
+	}
+	assert.Equal(t, map[int]string{
+		2: sendme.ProblemAddress + ";",
+		3: sendme.ProblemSkip + ";",
+		4: sendme.ProblemMissingKey + ";" + sendme.ProblemAttachment + ";",
+	}, kinds)
+	assert.Error(t, report.Err())
+	assert.Contains(t, report.String(), "row #4 (dave@example.com) [missing key]")
+
+	// nothing is sent when check fails
+	d.PreflightCheck = true
+	_, err = mailer.Send(context.Background())
+	assert.ErrorContains(t, err, "check failed, 3 problem(s) found")
+	assert.NoDirExists(t, d.PreviewDir)
+}
+
+func TestValidateMissingKey(t *testing.T) {
+	cases := map[string]func(d *sendme.DeliveryConfig, dir string){
+		"markdown layout": func(d *sendme.DeliveryConfig, dir string) {
+			d.MailFormat = sendme.MarkdownFormat
+			d.MarkdownLayoutFile = filepath.Join(dir, "layout.html")
+			writeFiles(t, dir, map[string]string{"layout.html": `{{.Body}}<p>{{.Data.Footer}}</p>`})
+		},
+		"pdf file name": func(d *sendme.DeliveryConfig, dir string) {
+			writeFiles(t, dir, map[string]string{"cert.html": `<p>{{.Name}}</p>`})
+			d.Pdf = []*sendme.PdfConfig{{
+				TemplateFile: filepath.Join(dir, "cert.html"),
+				FileName:     "cert-{{.Nick}}.pdf",
+				CreationDate: "2024-01-02",
+			}}
+		},
+		"attachment path": func(d *sendme.DeliveryConfig, dir string) {
+			writeFiles(t, dir, map[string]string{"a.txt": "a"})
+			d.AttachmentRoot = dir
+			assert.NoError(t, os.WriteFile(d.DataFile,
+				[]byte("Name,Email,attachment_1\nAlice,alice@example.com,{{.Folder}}a.txt\n"), 0644))
+		},
+	}
+	for name, setup := range cases {
+		conf := previewConfig(t, "Name,Email\nAlice,alice@example.com\n", "Dear {{.Name}}")
+		d := conf.Delivery
+		setup(d, filepath.Dir(d.TemplateFiles[0]))
+
+		mailer, err := sendme.NewMailer(conf)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		report, err := mailer.Validate(context.Background())
+		if assert.NoError(t, err, name) && assert.Len(t, report.Problems, 1, name) {
+			assert.Contains(t, report.Problems[0].Message, "map has no entry for key", name)
+		}
+	}
+}
+
+func TestPdfAttachment(t *testing.T) {
+	conf := previewConfig(t,
+		"Name,Email,Course\nAlice,alice@example.com,Go Programming\nBob,bob@example.com,Café Basics\n",
+		"Dear {{.Name}}, your certificate is attached.")
+	d := conf.Delivery
+	dir := filepath.Dir(d.TemplateFiles[0])
+	writeFiles(t, dir, map[string]string{
+		"certificate.html": `<h1 align="center">Certificate</h1>
+<p align="center">awarded to <b>{{.Name}}</b> for completing <i>{{.Course}}</i></p>
+<hr><table><tr><th>Course</th><th>Date</th></tr><tr><td>{{.Course}}</td><td>2024-01-02</td></tr></table>
+<ul><li>one</li><li><a href="https://example.com">two</a></li></ul>
+<p><img src="{{qrcode .Name}}" width="30" height="30">{{attachFile "terms.txt"}}</p>`,
+		"terms.txt": "terms and conditions",
+		"sent.txt":  "carol@example.com\n",
+	})
+	d.AttachmentRoot = dir
+	d.SkipIfSent = true
+	d.SentFile = filepath.Join(dir, "sent.txt")
+	d.Pdf = []*sendme.PdfConfig{{
+		TemplateFile: filepath.Join(dir, "certificate.html"),
+		FileName:     "certificate-{{.Name}}.pdf",
+		SaveDir:      filepath.Join(dir, "pdf"),
+		CreationDate: "2024-01-02",
+	}}
+	assert.NoError(t, appendFile(d.DataFile, "Carol,carol@example.com,Go Programming\n"))
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+	assert.Equal(t, 1, st.NumAlreadySent)
+
+	eml := readEml(t, filepath.Join(d.PreviewDir, "00001_alice@example.com.eml"))
+	assert.Contains(t, eml, `filename="certificate-Alice.pdf"`)
+	assert.Contains(t, eml, "application/pdf")
+	// file attached by PDF template, QR code is embedded in the PDF only
+	assert.Contains(t, eml, `filename="terms.txt"`)
+	assert.NotContains(t, eml, "qrcode-")
+
+	content, err := os.ReadFile(filepath.Join(dir, "pdf", "certificate-Bob.pdf"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(content), "%PDF-"))
+	assert.Contains(t, string(content), "/CreationDate (D:20240102")
+	assert.Contains(t, string(content), "/Subtype /Image")
+
+	// PDF of skipped row is not saved
+	assert.NoFileExists(t, filepath.Join(dir, "pdf", "certificate-Carol.pdf"))
+}
+
+// appendFile appends content to file
+func appendFile(filename, content string) error {
+	fd, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = fd.WriteString(content)
+	return err
+}
+
+func TestWorkers(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("Name,Email\n")
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&sb, "User %d,user%d@example.com\n", i, i)
+	}
+	sb.WriteString("Nobody,\n")
+	conf := previewConfig(t, sb.String(), "Dear {{.Name}}")
+	conf.Delivery.Workers = 4
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 51, st.Total)
+	assert.Equal(t, 50, st.NumSentData)
+	assert.Equal(t, 50, st.NumSentAddr)
+
+	files, err := filepath.Glob(filepath.Join(conf.Delivery.PreviewDir, "*.eml"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 50)
+	eml := readEml(t, filepath.Join(conf.Delivery.PreviewDir, "00050_user49@example.com.eml"))
+	assert.Contains(t, eml, "Dear User 49")
+}
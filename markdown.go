@@ -0,0 +1,78 @@
+package sendme
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// defaultMarkdownLayout is used if markdown layout file is not specified
+const defaultMarkdownLayout = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"></head>
+<body>
+{{.Body}}
+</body>
+</html>
+`
+
+// MarkdownPage is data passed to markdown layout template.
+// Converted message is in Body and row data in Data.
+type MarkdownPage struct {
+	Body template.HTML
+	Data MailData
+}
+
+// markdownRenderer converts markdown to HTML wrapped in layout
+type markdownRenderer struct {
+	md     goldmark.Markdown
+	layout *template.Template
+}
+
+// newMarkdownRenderer creates renderer with layout from file (optional)
+func newMarkdownRenderer(d *DeliveryConfig, loc *locale, funcs ...map[string]any) (*markdownRenderer, error) {
+	var err error
+	layout := template.New("layout").Funcs(sprig.FuncMap()).Funcs(loc.funcMap())
+	for _, fm := range funcs {
+		layout.Funcs(fm)
+	}
+	if d.MarkdownLayoutFile == "" {
+		layout, err = layout.Parse(defaultMarkdownLayout)
+	} else {
+		filename := loc.path(d.MarkdownLayoutFile)
+		layout, err = layout.ParseFiles(filename)
+		if err == nil {
+			layout = layout.Lookup(filepath.Base(filename))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse markdown layout error: %w", err)
+	}
+
+	md := goldmark.New(goldmark.WithExtensions(extension.GFM))
+	return &markdownRenderer{md: md, layout: layout}, nil
+}
+
+// Render converts markdown source and executes layout with the result
+func (r *markdownRenderer) Render(src string, datum MailData) (string, error) {
+	var buf bytes.Buffer
+	if err := r.md.Convert([]byte(src), &buf); err != nil {
+		return "", fmt.Errorf("convert markdown error: %w", err)
+	}
+
+	var sb strings.Builder
+	page := MarkdownPage{
+		Body: template.HTML(buf.String()),
+		Data: datum,
+	}
+	if err := r.layout.Execute(&sb, &page); err != nil {
+		return "", fmt.Errorf("execute markdown layout error: %w", err)
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,532 @@
+package sendme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/go-pdf/fpdf"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// PdfConfig generates PDF attachment of each row from template.
+// Template with .html/.htm extension is rendered as simple HTML
+// (headings, paragraphs, b/i/u, links, lists, tables, images, hr),
+// otherwise as plain text.
+type PdfConfig struct {
+	TemplateFile string  `json:"templateFile"`
+	FileName     string  `json:"fileName"`
+	PageSize     string  `json:"pageSize"`
+	Orientation  string  `json:"orientation"`
+	FontFile     string  `json:"fontFile"`
+	FontSize     float64 `json:"fontSize"`
+	SaveDir      string  `json:"saveDir"`
+	// CreationDate (2006-01-02 or RFC 3339) is recorded in the document,
+	// default is modification time of the template file
+	CreationDate string `json:"creationDate"`
+}
+
+// pdfGenerator renders PDF of a row
+type pdfGenerator struct {
+	conf     *PdfConfig
+	html     bool
+	htmlTpl  *htmltemplate.Template
+	textTpl  *texttemplate.Template
+	nameTpl  *texttemplate.Template
+	imageDir string
+	created  time.Time
+}
+
+func newPdfGenerators(d *DeliveryConfig, funcs []map[string]any) ([]*pdfGenerator, error) {
+	var gens []*pdfGenerator
+	for _, pc := range d.Pdf {
+		g, err := newPdfGenerator(pc, funcs)
+		if err != nil {
+			return nil, err
+		}
+		gens = append(gens, g)
+	}
+	return gens, nil
+}
+
+func newPdfGenerator(pc *PdfConfig, funcs []map[string]any) (*pdfGenerator, error) {
+	if pc.TemplateFile == "" {
+		return nil, errors.New("pdf template file not specified")
+	}
+	content, err := os.ReadFile(pc.TemplateFile)
+	if err != nil {
+		return nil, fmt.Errorf("read pdf template %s error: %w", pc.TemplateFile, err)
+	}
+	// fixed date, so that the same content gives identical document
+	created, err := pdfCreationDate(pc)
+	if err != nil {
+		return nil, err
+	}
+	fileName := pc.FileName
+	if fileName == "" {
+		fileName = strings.TrimSuffix(filepath.Base(pc.TemplateFile), filepath.Ext(pc.TemplateFile)) + ".pdf"
+	}
+
+	g := pdfGenerator{
+		conf:     pc,
+		imageDir: filepath.Dir(pc.TemplateFile),
+		created:  created,
+	}
+	name := filepath.Base(pc.TemplateFile)
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".html", ".htm":
+		g.html = true
+		g.htmlTpl = htmltemplate.New(name).Funcs(sprig.FuncMap())
+		for _, fm := range funcs {
+			g.htmlTpl.Funcs(fm)
+		}
+		_, err = g.htmlTpl.Parse(string(content))
+	default:
+		g.textTpl = texttemplate.New(name).Funcs(sprig.TxtFuncMap())
+		for _, fm := range funcs {
+			g.textTpl.Funcs(fm)
+		}
+		_, err = g.textTpl.Parse(string(content))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse pdf template %s error: %w", pc.TemplateFile, err)
+	}
+	if g.nameTpl, err = texttemplate.New("fileName").Funcs(sprig.TxtFuncMap()).Parse(fileName); err != nil {
+		return nil, fmt.Errorf("parse pdf file name template error: %w", err)
+	}
+	return &g, nil
+}
+
+// pdfCreationDate returns configured creation date or modification
+// time of the template
+func pdfCreationDate(pc *PdfConfig) (time.Time, error) {
+	if pc.CreationDate == "" {
+		fi, err := os.Stat(pc.TemplateFile)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("read pdf template %s error: %w", pc.TemplateFile, err)
+		}
+		return fi.ModTime().UTC().Truncate(time.Second), nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, pc.CreationDate); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid pdf creation date `%s`", pc.CreationDate)
+}
+
+// Generate renders PDF of the row as attachment. Images with cid: source,
+// e.g. created by qrcode, are taken from images.
+func (g *pdfGenerator) Generate(datum MailData, images func(name string) []byte) (*AttachmentFile, error) {
+	var sb strings.Builder
+	var err error
+	if g.html {
+		err = g.htmlTpl.Execute(&sb, datum)
+	} else {
+		err = g.textTpl.Execute(&sb, datum)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execute pdf template error: %w", err)
+	}
+	var nb strings.Builder
+	if err := g.nameTpl.Execute(&nb, datum); err != nil {
+		return nil, fmt.Errorf("execute pdf file name error: %w", err)
+	}
+	name := safeFileName(strings.TrimSpace(nb.String()))
+	if name == "" {
+		return nil, errors.New("pdf file name is empty")
+	}
+
+	pdf, err := g.newDocument()
+	if err != nil {
+		return nil, err
+	}
+	if g.html {
+		w := pdfWriter{pdf: pdf, tr: g.translator(pdf), size: g.fontSize(), imageDir: g.imageDir, images: images}
+		if err := w.render(sb.String()); err != nil {
+			return nil, err
+		}
+	} else {
+		pdf.MultiCell(0, g.fontSize()*0.5, g.translator(pdf)(sb.String()), "", "L", false)
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, fmt.Errorf("generate pdf %s error: %w", name, err)
+	}
+	return &AttachmentFile{Key: "pdf", Name: name, Data: buf.Bytes()}, nil
+}
+
+// save writes generated PDF to save directory if configured
+func (g *pdfGenerator) save(af *AttachmentFile) error {
+	if g.conf.SaveDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(g.conf.SaveDir, 0755); err != nil {
+		return fmt.Errorf("create pdf directory error: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(g.conf.SaveDir, af.Name), af.Data, 0644); err != nil {
+		return fmt.Errorf("write pdf %s error: %w", af.Name, err)
+	}
+	return nil
+}
+
+// template returns parsed body template
+func (g *pdfGenerator) template() Executer {
+	if g.html {
+		return g.htmlTpl
+	}
+	return g.textTpl
+}
+
+func (g *pdfGenerator) fontSize() float64 {
+	if g.conf.FontSize > 0 {
+		return g.conf.FontSize
+	}
+	return 11
+}
+
+func (g *pdfGenerator) newDocument() (*fpdf.Fpdf, error) {
+	orientation := "P"
+	if strings.HasPrefix(strings.ToUpper(g.conf.Orientation), "L") {
+		orientation = "L"
+	}
+	size := g.conf.PageSize
+	if size == "" {
+		size = "A4"
+	}
+	pdf := fpdf.New(orientation, "mm", size, "")
+	pdf.SetCatalogSort(true)
+	pdf.SetCreationDate(g.created)
+	pdf.SetModificationDate(g.created)
+
+	family := "Helvetica"
+	if g.conf.FontFile != "" {
+		// single font file is used for every style
+		family = "body"
+		for _, style := range []string{"", "B", "I", "BI"} {
+			pdf.AddUTF8Font(family, style, g.conf.FontFile)
+		}
+	}
+	pdf.SetFont(family, "", g.fontSize())
+	pdf.AddPage()
+	if err := pdf.Error(); err != nil {
+		return nil, fmt.Errorf("create pdf error: %w", err)
+	}
+	return pdf, nil
+}
+
+// translator converts UTF-8 text for core fonts
+func (g *pdfGenerator) translator(pdf *fpdf.Fpdf) func(string) string {
+	if g.conf.FontFile != "" {
+		return func(s string) string { return s }
+	}
+	return pdf.UnicodeTranslatorFromDescriptor("")
+}
+
+// pdfWriter lays out simple HTML into PDF
+type pdfWriter struct {
+	pdf      *fpdf.Fpdf
+	tr       func(string) string
+	size     float64
+	imageDir string
+	images   func(name string) []byte
+	bold     int
+	italic   int
+	under    int
+	scale    float64
+	align    string
+	href     string
+	lists    []int
+}
+
+func (w *pdfWriter) render(src string) error {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return fmt.Errorf("parse pdf html error: %w", err)
+	}
+	w.scale = 1
+	w.align = "L"
+	w.walk(doc)
+	if err := w.pdf.Error(); err != nil {
+		return fmt.Errorf("render pdf error: %w", err)
+	}
+	return nil
+}
+
+func (w *pdfWriter) lineHeight() float64 {
+	return w.size * w.scale * 0.5
+}
+
+func (w *pdfWriter) setFont() {
+	style := ""
+	if w.bold > 0 {
+		style += "B"
+	}
+	if w.italic > 0 {
+		style += "I"
+	}
+	if w.under > 0 {
+		style += "U"
+	}
+	w.pdf.SetFontStyle(style)
+	w.pdf.SetFontSize(w.size * w.scale)
+}
+
+// newline starts new line if current position is not at line start
+func (w *pdfWriter) newline(gap float64) {
+	left, _, _, _ := w.pdf.GetMargins()
+	if w.pdf.GetX() > left+0.01 {
+		w.pdf.Ln(w.lineHeight())
+	}
+	if gap > 0 {
+		w.pdf.Ln(gap)
+	}
+}
+
+func (w *pdfWriter) text(s string) {
+	s = collapseSpace(s)
+	if strings.TrimSpace(s) == "" {
+		left, _, _, _ := w.pdf.GetMargins()
+		if w.pdf.GetX() > left+0.01 && s != "" {
+			w.pdf.Write(w.lineHeight(), " ")
+		}
+		return
+	}
+	left, _, _, _ := w.pdf.GetMargins()
+	if w.pdf.GetX() <= left+0.01 {
+		s = strings.TrimLeft(s, " ")
+	}
+	switch {
+	case w.href != "":
+		w.pdf.WriteLinkString(w.lineHeight(), w.tr(s), w.href)
+	case w.align != "L":
+		w.pdf.WriteAligned(0, w.lineHeight(), w.tr(strings.TrimSpace(s)), w.align)
+	default:
+		w.pdf.Write(w.lineHeight(), w.tr(s))
+	}
+}
+
+func (w *pdfWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.walk(c)
+	}
+}
+
+// block renders children of block element with alignment
+func (w *pdfWriter) block(n *html.Node, gap float64) {
+	w.newline(0)
+	align := w.align
+	switch strings.ToLower(attr(n, "align")) {
+	case "center":
+		w.align = "C"
+	case "right":
+		w.align = "R"
+	}
+	style := strings.ReplaceAll(strings.ToLower(attr(n, "style")), " ", "")
+	if strings.Contains(style, "text-align:center") {
+		w.align = "C"
+	} else if strings.Contains(style, "text-align:right") {
+		w.align = "R"
+	}
+	w.children(n)
+	w.align = align
+	w.newline(gap)
+}
+
+func (w *pdfWriter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.DocumentNode:
+		w.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title:
+	case atom.B, atom.Strong:
+		w.bold++
+		w.setFont()
+		w.children(n)
+		w.bold--
+		w.setFont()
+	case atom.I, atom.Em:
+		w.italic++
+		w.setFont()
+		w.children(n)
+		w.italic--
+		w.setFont()
+	case atom.U:
+		w.under++
+		w.setFont()
+		w.children(n)
+		w.under--
+		w.setFont()
+	case atom.A:
+		href := w.href
+		w.href = attr(n, "href")
+		w.under++
+		w.setFont()
+		w.children(n)
+		w.under--
+		w.setFont()
+		w.href = href
+	case atom.Br:
+		w.pdf.Ln(w.lineHeight())
+	case atom.H1, atom.H2, atom.H3, atom.H4:
+		scale := map[atom.Atom]float64{atom.H1: 2, atom.H2: 1.6, atom.H3: 1.3, atom.H4: 1.1}[n.DataAtom]
+		w.newline(0)
+		w.scale, w.bold = scale, w.bold+1
+		w.setFont()
+		w.block(n, w.lineHeight()/2)
+		w.scale, w.bold = 1, w.bold-1
+		w.setFont()
+	case atom.P, atom.Div, atom.Center, atom.Blockquote:
+		if n.DataAtom == atom.Center {
+			setAttr(n, "align", "center")
+		}
+		w.block(n, w.lineHeight()/2)
+	case atom.Ul, atom.Ol:
+		w.newline(0)
+		w.lists = append(w.lists, 0)
+		if n.DataAtom == atom.Ul {
+			w.lists[len(w.lists)-1] = -1
+		}
+		w.children(n)
+		w.lists = w.lists[:len(w.lists)-1]
+		w.newline(w.lineHeight() / 2)
+	case atom.Li:
+		w.newline(0)
+		bullet := "- "
+		if depth := len(w.lists); depth > 0 && w.lists[depth-1] >= 0 {
+			w.lists[depth-1]++
+			bullet = strconv.Itoa(w.lists[depth-1]) + ". "
+		}
+		w.pdf.Write(w.lineHeight(), strings.Repeat("    ", len(w.lists))+bullet)
+		w.children(n)
+		w.newline(0)
+	case atom.Hr:
+		w.newline(0)
+		left, _, right, _ := w.pdf.GetMargins()
+		pw, _ := w.pdf.GetPageSize()
+		y := w.pdf.GetY() + 1
+		w.pdf.Line(left, y, pw-right, y)
+		w.pdf.Ln(3)
+	case atom.Img:
+		w.image(n)
+	case atom.Table:
+		w.newline(0)
+		w.table(n)
+		w.newline(w.lineHeight() / 2)
+	default:
+		w.children(n)
+	}
+}
+
+// image places local or generated (cid:) image, width/height attributes
+// are in millimeters
+func (w *pdfWriter) image(n *html.Node) {
+	src := attr(n, "src")
+	if strings.HasPrefix(src, "cid:") {
+		name := strings.TrimPrefix(src, "cid:")
+		var data []byte
+		if w.images != nil {
+			data = w.images(name)
+		}
+		if data == nil {
+			return
+		}
+		opts := fpdf.ImageOptions{ImageType: strings.TrimPrefix(filepath.Ext(name), "."), ReadDpi: true}
+		w.pdf.RegisterImageOptionsReader(src, opts, bytes.NewReader(data))
+	} else if src == "" || !isLocalRef(src) {
+		return
+	} else if !filepath.IsAbs(src) {
+		src = filepath.Join(w.imageDir, src)
+	}
+	width, _ := strconv.ParseFloat(attr(n, "width"), 64)
+	height, _ := strconv.ParseFloat(attr(n, "height"), 64)
+	w.newline(0)
+	x := -1.0
+	if w.align == "C" && width > 0 {
+		pw, _ := w.pdf.GetPageSize()
+		x = (pw - width) / 2
+	}
+	w.pdf.ImageOptions(src, x, -1, width, height, true, fpdf.ImageOptions{ReadDpi: true}, 0, "")
+}
+
+// table renders rows with equal column widths and borders
+func (w *pdfWriter) table(n *html.Node) {
+	var rows [][]*html.Node
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				collect(c)
+			case atom.Tr:
+				var cells []*html.Node
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+						cells = append(cells, cell)
+					}
+				}
+				if len(cells) > 0 {
+					rows = append(rows, cells)
+				}
+			}
+		}
+	}
+	collect(n)
+
+	ncol := 0
+	for _, row := range rows {
+		if len(row) > ncol {
+			ncol = len(row)
+		}
+	}
+	if ncol == 0 {
+		return
+	}
+	left, _, right, _ := w.pdf.GetMargins()
+	pw, _ := w.pdf.GetPageSize()
+	cw := (pw - left - right) / float64(ncol)
+	for _, row := range rows {
+		for i, cell := range row {
+			if cell.DataAtom == atom.Th {
+				w.bold++
+				w.setFont()
+			}
+			align := "L"
+			switch strings.ToLower(attr(cell, "align")) {
+			case "center":
+				align = "C"
+			case "right":
+				align = "R"
+			}
+			ln := 0
+			if i == len(row)-1 {
+				ln = 1
+			}
+			text := strings.Join(strings.Fields(nodeText(cell)), " ")
+			w.pdf.CellFormat(cw, w.lineHeight()+2, w.tr(text), "1", ln, align, false, 0, "")
+			if cell.DataAtom == atom.Th {
+				w.bold--
+				w.setFont()
+			}
+		}
+	}
+}
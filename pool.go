@@ -0,0 +1,117 @@
+package sendme
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// sendStats guards Stats updated by producer and workers
+type sendStats struct {
+	mu sync.Mutex
+	st Stats
+}
+
+func (s *sendStats) update(fn func(st *Stats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.st)
+}
+
+func (s *sendStats) get() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.st
+}
+
+// lockedUi serialises output and confirmation of producer and workers
+type lockedUi struct {
+	mu sync.Mutex
+	ui Ui
+}
+
+func (u *lockedUi) Logf(format string, args ...any) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.ui.Logf(format, args...)
+}
+
+func (u *lockedUi) Confirm(msg string) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.ui.Confirm(msg)
+}
+
+// senderPool delivers prepared messages through transport by workers.
+// Transport is not used in preview mode. Exhausted quota or unavailability
+// of every server stops the pool.
+type senderPool struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	jobs    chan *delivery
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+	mu      sync.Mutex
+	failed  error
+}
+
+func newSenderPool(ctx context.Context, m *Mailer, tr Transport, workers int, st *sendStats) *senderPool {
+	p := senderPool{jobs: make(chan *delivery, workers)}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for dv := range p.jobs {
+				// queued messages are not sent once the pool is stopped
+				if p.ctx.Err() != nil {
+					st.update(func(s *Stats) { s.NumUnsent++ })
+				} else {
+					err := m.deliver(p.ctx, tr, dv, st)
+					if errors.Is(err, ErrQuotaExhausted) || errors.Is(err, ErrNoServer) {
+						p.fail(err)
+					} else if err != nil {
+						m.ui.Logf("Error when sending email: %v\n", err)
+					}
+				}
+				p.pending.Done()
+			}
+		}()
+	}
+	return &p
+}
+
+// fail stops the pool with error
+func (p *senderPool) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failed == nil {
+		p.failed = err
+	}
+	p.cancel()
+}
+
+// err returns error which stopped the pool
+func (p *senderPool) err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failed
+}
+
+// submit queues message, blocks while all workers are busy
+func (p *senderPool) submit(dv *delivery) {
+	p.pending.Add(1)
+	p.jobs <- dv
+}
+
+// drain waits until all queued messages are delivered
+func (p *senderPool) drain() {
+	p.pending.Wait()
+}
+
+// close waits for queued messages and stops workers
+func (p *senderPool) close() {
+	close(p.jobs)
+	p.workers.Wait()
+	p.cancel()
+}
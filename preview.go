@@ -0,0 +1,42 @@
+package sendme
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// writePreview writes complete RFC 5322 message into .eml file
+// named by row index and first recipient.
+func writePreview(dir string, row int, toList []*netmail.Address, msg *mail.Email) (string, error) {
+	if err := msg.GetError(); err != nil {
+		return "", fmt.Errorf("build message error: %w", err)
+	}
+
+	rcpt := "unknown"
+	if len(toList) > 0 {
+		rcpt = toList[0].Address
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("%05d_%s.eml", row, safeFileName(rcpt)))
+	if err := os.WriteFile(filename, []byte(msg.GetMessage()), 0644); err != nil {
+		return "", fmt.Errorf("write preview %s error: %w", filename, err)
+	}
+	return filename, nil
+}
+
+// safeFileName replaces characters which are not safe for file name
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '@' || r == '.' || r == '-' || r == '_' || r == '+':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,308 @@
+package sendme
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action when hourly or daily quota is exhausted
+const (
+	QuotaWait = "WAIT"
+	QuotaStop = "STOP"
+)
+
+// ErrQuotaExhausted is returned by RateLimiter when quota is exhausted
+// and configured to stop.
+var ErrQuotaExhausted = errors.New("sending quota exhausted")
+
+// RateLimitConfig limits sending rate. Rate is a token bucket of burst size
+// refilled perMinute, hourly and daily quotas are counted per clock hour
+// and calendar day. Domain limits apply to messages with recipient in domain.
+// Every limit counts messages: message to many recipients counts once
+// (once per domain) and retry of a message is not counted again.
+type RateLimitConfig struct {
+	Burst         int                  `json:"burst"`
+	PerMinute     int                  `json:"perMinute"`
+	PerHour       int                  `json:"perHour"`
+	PerDay        int                  `json:"perDay"`
+	Domains       []*DomainLimitConfig `json:"domains"`
+	WhenExhausted string               `json:"whenExhausted"`
+	StateFile     string               `json:"stateFile"`
+}
+
+// DomainLimitConfig limits messages to recipient domain
+type DomainLimitConfig struct {
+	Domain    string `json:"domain"`
+	PerMinute int    `json:"perMinute"`
+	PerHour   int    `json:"perHour"`
+	PerDay    int    `json:"perDay"`
+}
+
+// quota is a token bucket with fixed hourly and daily windows
+type quota struct {
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	perHour int
+	perDay  int
+	hour    time.Time
+	day     time.Time
+	nHour   int
+	nDay    int
+}
+
+func newQuota(perMinute, perHour, perDay, burst int) *quota {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &quota{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		perHour: perHour,
+		perDay:  perDay,
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// roll resets counters when window changes and refills tokens
+func (q *quota) roll(now time.Time) {
+	if h := now.Truncate(time.Hour); !h.Equal(q.hour) {
+		q.hour, q.nHour = h, 0
+	}
+	if d := startOfDay(now); !d.Equal(q.day) {
+		q.day, q.nDay = d, 0
+	}
+	if q.rate > 0 && !q.last.IsZero() {
+		q.tokens = math.Min(q.burst, q.tokens+now.Sub(q.last).Seconds()*q.rate)
+	}
+	q.last = now
+}
+
+// next returns time when message may be sent. Windowed is true
+// if hourly or daily quota is exhausted, windows are only checked
+// for message which is counted.
+func (q *quota) next(now time.Time, count bool) (at time.Time, windowed bool) {
+	q.roll(now)
+	at = now
+	if count && q.perDay > 0 && q.nDay >= q.perDay {
+		at, windowed = q.day.AddDate(0, 0, 1), true
+	} else if count && q.perHour > 0 && q.nHour >= q.perHour {
+		at, windowed = q.hour.Add(time.Hour), true
+	}
+	if q.rate > 0 && q.tokens < 1 {
+		wait := time.Duration((1 - q.tokens) / q.rate * float64(time.Second))
+		if t := now.Add(wait); t.After(at) {
+			at = t
+		}
+	}
+	return at, windowed
+}
+
+func (q *quota) take(count bool) {
+	if q.rate > 0 {
+		q.tokens--
+	}
+	if count {
+		q.nHour++
+		q.nDay++
+	}
+}
+
+// quotaState is daily counter persisted between runs
+type quotaState struct {
+	Day     string         `json:"day"`
+	Sent    int            `json:"sent"`
+	Domains map[string]int `json:"domains,omitempty"`
+}
+
+// RateLimiter paces sending of all workers. It is safe for concurrent use.
+type RateLimiter struct {
+	mu        sync.Mutex
+	global    *quota
+	domains   map[string]*quota
+	stop      bool
+	stateFile string
+}
+
+// NewRateLimiter creates limiter from configuration. Without perMinute,
+// interval between messages is used as rate. Daily counters are loaded
+// from state file if exists.
+func NewRateLimiter(conf *RateLimitConfig, interval time.Duration) (*RateLimiter, error) {
+	if conf == nil {
+		conf = &RateLimitConfig{}
+	}
+	l := RateLimiter{
+		domains:   make(map[string]*quota),
+		stateFile: conf.StateFile,
+	}
+	switch strings.ToUpper(conf.WhenExhausted) {
+	case "", QuotaWait:
+	case QuotaStop:
+		l.stop = true
+	default:
+		return nil, fmt.Errorf("unknown quota action: %s", conf.WhenExhausted)
+	}
+
+	l.global = newQuota(conf.PerMinute, conf.PerHour, conf.PerDay, conf.Burst)
+	if conf.PerMinute <= 0 && interval > 0 {
+		l.global.rate = 1 / interval.Seconds()
+	}
+	for _, dc := range conf.Domains {
+		domain := strings.ToLower(strings.TrimSpace(dc.Domain))
+		if domain == "" {
+			return nil, errors.New("domain of rate limit not specified")
+		}
+		l.domains[domain] = newQuota(dc.PerMinute, dc.PerHour, dc.PerDay, 1)
+	}
+
+	if err := l.load(time.Now()); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// Wait blocks until message to recipients may be sent,
+// message is counted in hourly and daily quotas
+func (l *RateLimiter) Wait(ctx context.Context, recipients []string) error {
+	return l.wait(ctx, recipients, true)
+}
+
+// WaitRetry blocks until message may be sent again. Retry takes rate,
+// but is not counted again in hourly and daily quotas.
+func (l *RateLimiter) WaitRetry(ctx context.Context, recipients []string) error {
+	return l.wait(ctx, recipients, false)
+}
+
+func (l *RateLimiter) wait(ctx context.Context, recipients []string, count bool) error {
+	domains := recipientDomains(recipients)
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		at, windowed := l.global.next(now, count)
+		quotas := []*quota{l.global}
+		for _, domain := range domains {
+			q, ok := l.domains[domain]
+			if !ok {
+				continue
+			}
+			t, w := q.next(now, count)
+			if t.After(at) {
+				at = t
+			}
+			windowed = windowed || w
+			quotas = append(quotas, q)
+		}
+		if !at.After(now) {
+			for _, q := range quotas {
+				q.take(count)
+			}
+			if !count {
+				l.mu.Unlock()
+				return nil
+			}
+			err := l.save()
+			l.mu.Unlock()
+			return err
+		}
+		l.mu.Unlock()
+
+		if windowed && l.stop {
+			return fmt.Errorf("%w, next window at %s", ErrQuotaExhausted, at.Format(time.RFC3339))
+		}
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// load restores daily counters of today
+func (l *RateLimiter) load(now time.Time) error {
+	if l.stateFile == "" {
+		return nil
+	}
+	content, err := os.ReadFile(l.stateFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read quota state %s error: %w", l.stateFile, err)
+	}
+	state := quotaState{}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return fmt.Errorf("parse quota state %s error: %w", l.stateFile, err)
+	}
+	if state.Day != now.Format("2006-01-02") {
+		return nil
+	}
+	l.global.roll(now)
+	l.global.nDay = state.Sent
+	for domain, n := range state.Domains {
+		if q, ok := l.domains[domain]; ok {
+			q.roll(now)
+			q.nDay = n
+		}
+	}
+	return nil
+}
+
+// save writes daily counters, must be called with lock held
+func (l *RateLimiter) save() error {
+	if l.stateFile == "" {
+		return nil
+	}
+	state := quotaState{
+		Day:     l.global.day.Format("2006-01-02"),
+		Sent:    l.global.nDay,
+		Domains: make(map[string]int),
+	}
+	for domain, q := range l.domains {
+		if q.day.Equal(l.global.day) && q.nDay > 0 {
+			state.Domains[domain] = q.nDay
+		}
+	}
+	content, err := json.Marshal(&state)
+	if err != nil {
+		return fmt.Errorf("encode quota state error: %w", err)
+	}
+	tmp := l.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("write quota state %s error: %w", l.stateFile, err)
+	}
+	if err := os.Rename(tmp, l.stateFile); err != nil {
+		return fmt.Errorf("write quota state %s error: %w", l.stateFile, err)
+	}
+	return nil
+}
+
+// recipientDomains returns distinct lower case domains of addresses
+func recipientDomains(recipients []string) []string {
+	var domains []string
+	for _, addr := range recipients {
+		at := strings.LastIndex(addr, "@")
+		if at < 0 {
+			continue
+		}
+		domain := strings.ToLower(strings.Trim(addr[at+1:], " >"))
+		if !containsString(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
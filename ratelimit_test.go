@@ -0,0 +1,63 @@
+package sendme_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipsusila/sendme"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	rl, err := sendme.NewRateLimiter(&sendme.RateLimitConfig{Burst: 3, PerMinute: 60}, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, rl.Wait(ctx, []string{"a@example.com"}))
+	}
+
+	// bucket is empty, next token in about one second
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, rl.Wait(ctx, []string{"a@example.com"}), context.DeadlineExceeded)
+}
+
+func TestRateLimiterQuota(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "quota.json")
+	conf := sendme.RateLimitConfig{
+		Burst:         10,
+		PerMinute:     600,
+		PerDay:        3,
+		WhenExhausted: sendme.QuotaStop,
+		StateFile:     state,
+		Domains: []*sendme.DomainLimitConfig{
+			{Domain: "Gmail.com", PerHour: 1},
+		},
+	}
+	rl, err := sendme.NewRateLimiter(&conf, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	assert.NoError(t, rl.Wait(ctx, []string{"a@gmail.com", "b@gmail.com"}))
+	// retry is not counted again
+	assert.NoError(t, rl.WaitRetry(ctx, []string{"a@gmail.com", "b@gmail.com"}))
+	assert.ErrorIs(t, rl.Wait(ctx, []string{"c@GMAIL.com"}), sendme.ErrQuotaExhausted)
+	assert.NoError(t, rl.Wait(ctx, []string{"d@example.com"}))
+
+	// daily counter survives restart
+	rl, err = sendme.NewRateLimiter(&conf, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, rl.Wait(ctx, []string{"e@example.com"}))
+	assert.ErrorIs(t, rl.Wait(ctx, []string{"f@example.com"}), sendme.ErrQuotaExhausted)
+
+	conf.WhenExhausted = "later"
+	_, err = sendme.NewRateLimiter(&conf, 0)
+	assert.Error(t, err)
+}
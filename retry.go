@@ -0,0 +1,132 @@
+package sendme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"syscall"
+	"time"
+)
+
+// RetryConfig retries transient failures with exponential backoff
+type RetryConfig struct {
+	MaxAttempts    int    `json:"maxAttempts"`
+	InitialBackoff string `json:"initialBackoff"`
+	MaxBackoff     string `json:"maxBackoff"`
+}
+
+type retryPolicy struct {
+	attempts int
+	initial  time.Duration
+	max      time.Duration
+}
+
+func newRetryPolicy(conf *RetryConfig) (*retryPolicy, error) {
+	p := retryPolicy{attempts: 3, initial: 2 * time.Second, max: time.Minute}
+	if conf == nil {
+		return &p, nil
+	}
+	if conf.MaxAttempts > 0 {
+		p.attempts = conf.MaxAttempts
+	}
+	var err error
+	if conf.InitialBackoff != "" {
+		if p.initial, err = time.ParseDuration(conf.InitialBackoff); err != nil {
+			return nil, fmt.Errorf("parsing initial backoff `%s` error: %w", conf.InitialBackoff, err)
+		}
+	}
+	if conf.MaxBackoff != "" {
+		if p.max, err = time.ParseDuration(conf.MaxBackoff); err != nil {
+			return nil, fmt.Errorf("parsing max backoff `%s` error: %w", conf.MaxBackoff, err)
+		}
+	}
+	return &p, nil
+}
+
+// backoff returns delay before the next attempt, doubled after every
+// attempt up to max, with random jitter of up to half of the delay.
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	d := p.initial
+	for i := 1; i < attempt && d < p.max; i++ {
+		d *= 2
+	}
+	if d > p.max {
+		d = p.max
+	}
+	if half := int64(d / 2); half > 0 {
+		d = time.Duration(half + rand.Int63n(half+1))
+	}
+	return d
+}
+
+// isTransientError returns true for 4xx SMTP replies, temporary delivery
+// errors, network errors, timeouts and connection failures. Other errors,
+// including 5xx replies, are permanent.
+func isTransientError(err error) bool {
+	var ce *connectError
+	if errors.As(err, &ce) {
+		return true
+	}
+	var de *DeliveryError
+	if errors.As(err, &de) {
+		return !de.Permanent
+	}
+	var tpe *textproto.Error
+	if errors.As(err, &tpe) {
+		return tpe.Code >= 400 && tpe.Code < 500
+	}
+	return isNetworkError(err)
+}
+
+// isNetworkError returns true if connection must be re-established
+func isNetworkError(err error) bool {
+	var tpe *textproto.Error
+	if errors.As(err, &tpe) {
+		// service not available, closing transmission channel
+		return tpe.Code == 421
+	}
+	// syscall.Errno implements net.Error, so only timeout is checked
+	var oe *net.OpError
+	var ne net.Error
+	switch {
+	case errors.As(err, &oe),
+		errors.As(err, &ne) && ne.Timeout(),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	}
+	return false
+}
+
+// sendWithRetry sends message, transient failures are retried with backoff.
+// Returns result and number of attempts, error is of the last attempt.
+func (m *Mailer) sendWithRetry(ctx context.Context, tr Transport, dv *delivery, st *sendStats) (*DeliveryResult, int, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := tr.Send(ctx, dv.message)
+		if err == nil || !isTransientError(err) || attempt >= m.retry.attempts {
+			return res, attempt, err
+		}
+
+		delay := m.retry.backoff(attempt)
+		m.ui.Logf("[WARN] Sending email to %s failed (attempt %d): %v, retry in %v\n",
+			dv.dest, attempt, err, delay.Round(time.Millisecond))
+		st.update(func(s *Stats) { s.NumRetry++ })
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return res, attempt, fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		case <-timer.C:
+		}
+		if werr := m.limiter.WaitRetry(ctx, dv.recipients); werr != nil {
+			return res, attempt, fmt.Errorf("%w, last error: %v", werr, err)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package sendme
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Column types
+const (
+	TypeString  = "string"
+	TypeInt     = "int"
+	TypeDecimal = "decimal"
+	TypeDate    = "date"
+	TypeBool    = "bool"
+	TypeEmail   = "email"
+	TypeURL     = "url"
+)
+
+// default layout for date column
+const defaultDateLayout = "2006-01-02"
+
+// FieldError describes invalid column value
+type FieldError struct {
+	Column string
+	Value  string
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("column `%s`: %s", e.Column, e.Reason)
+	}
+	return fmt.Sprintf("column `%s` value `%s`: %s", e.Column, e.Value, e.Reason)
+}
+
+// ValidationError lists all invalid columns of a row
+type ValidationError []*FieldError
+
+func (v ValidationError) Error() string {
+	items := make([]string, len(v))
+	for i, fe := range v {
+		items[i] = fe.Error()
+	}
+	return strings.Join(items, "; ")
+}
+
+// Schema converts and validates row values according to column configuration
+type Schema struct {
+	columns []*schemaColumn
+}
+
+type schemaColumn struct {
+	*ColumnConfig
+	key     string
+	pattern *regexp.Regexp
+	def     any
+}
+
+// NewSchema compiles column configuration. Nil schema is returned
+// if no column is configured.
+func NewSchema(cols []*ColumnConfig) (*Schema, error) {
+	if len(cols) == 0 {
+		return nil, nil
+	}
+	s := Schema{}
+	for _, cc := range cols {
+		if cc == nil || cc.Name == "" {
+			return nil, fmt.Errorf("column name not specified")
+		}
+		sc := schemaColumn{
+			ColumnConfig: cc,
+			key:          cc.Name,
+		}
+		if cc.As != "" {
+			sc.key = cc.As
+		}
+		switch strings.ToLower(cc.Type) {
+		case "", TypeString, TypeInt, TypeDecimal, TypeDate, TypeBool, TypeEmail, TypeURL:
+		default:
+			return nil, fmt.Errorf("column `%s`: unknown type %s", cc.Name, cc.Type)
+		}
+		if cc.Pattern != "" {
+			re, err := regexp.Compile(cc.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("column `%s`: invalid pattern: %w", cc.Name, err)
+			}
+			sc.pattern = re
+		}
+		if cc.Default != "" {
+			def, err := sc.convert(cc.Default)
+			if err != nil {
+				return nil, fmt.Errorf("column `%s`: invalid default `%s`: %w", cc.Name, cc.Default, err)
+			}
+			sc.def = def
+		}
+		s.columns = append(s.columns, &sc)
+	}
+	return &s, nil
+}
+
+// Apply converts, validates and renames configured columns in place.
+// All failures in the row are returned as ValidationError.
+func (s *Schema) Apply(md MailData) error {
+	if s == nil {
+		return nil
+	}
+	var verr ValidationError
+	for _, sc := range s.columns {
+		name, val := sc.lookup(md)
+		if name != "" && name != sc.key {
+			delete(md, name)
+		}
+
+		// empty value, use default
+		str := strings.TrimSpace(valueString(val))
+		if str == "" {
+			switch {
+			case sc.def != nil:
+				md[sc.key] = sc.def
+			case sc.Required:
+				verr = append(verr, &FieldError{Column: sc.Name, Reason: "required value is empty"})
+			case name != "":
+				// absent column is not added, so missing key is reported
+				md[sc.key] = val
+			}
+			continue
+		}
+
+		if sc.pattern != nil && !sc.pattern.MatchString(str) {
+			verr = append(verr, &FieldError{Column: sc.Name, Value: str, Reason: "does not match pattern " + sc.Pattern})
+			continue
+		}
+		if len(sc.Enum) > 0 && !containsString(sc.Enum, str) {
+			verr = append(verr, &FieldError{Column: sc.Name, Value: str, Reason: "not one of " + strings.Join(sc.Enum, ", ")})
+			continue
+		}
+
+		typed, err := sc.convertValue(val, str)
+		if err != nil {
+			verr = append(verr, &FieldError{Column: sc.Name, Value: str, Reason: err.Error()})
+			continue
+		}
+		md[sc.key] = typed
+	}
+	if len(verr) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// lookup returns actual column name and value by name or aliases
+func (sc *schemaColumn) lookup(md MailData) (string, any) {
+	if val, ok := md[sc.Name]; ok {
+		return sc.Name, val
+	}
+	for _, alias := range sc.Aliases {
+		if val, ok := md[alias]; ok {
+			return alias, val
+		}
+	}
+	return "", nil
+}
+
+// convertValue keeps value which already has the target type
+// (e.g. from database), otherwise converts its string representation.
+func (sc *schemaColumn) convertValue(val any, str string) (any, error) {
+	switch val.(type) {
+	case int64:
+		if sc.typ() == TypeInt {
+			return val, nil
+		}
+	case decimal.Decimal:
+		if sc.typ() == TypeDecimal {
+			return val, nil
+		}
+	case time.Time:
+		if sc.typ() == TypeDate {
+			return val, nil
+		}
+	case bool:
+		if sc.typ() == TypeBool {
+			return val, nil
+		}
+	}
+	return sc.convert(str)
+}
+
+func (sc *schemaColumn) typ() string {
+	return strings.ToLower(sc.Type)
+}
+
+func (sc *schemaColumn) convert(str string) (any, error) {
+	switch sc.typ() {
+	case TypeInt:
+		v, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer")
+		}
+		return v, nil
+	case TypeDecimal:
+		v, err := decimal.NewFromString(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decimal")
+		}
+		return v, nil
+	case TypeDate:
+		layout := sc.Layout
+		if layout == "" {
+			layout = defaultDateLayout
+		}
+		v, err := time.ParseInLocation(layout, str, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date, expecting layout %s", layout)
+		}
+		return v, nil
+	case TypeBool:
+		v, err := strconv.ParseBool(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean")
+		}
+		return v, nil
+	case TypeEmail:
+		if _, err := ParseAddressList(str); err != nil {
+			return nil, fmt.Errorf("invalid email address")
+		}
+		return str, nil
+	case TypeURL:
+		u, err := url.ParseRequestURI(str)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL")
+		}
+		return str, nil
+	}
+	return str, nil
+}
+
+// valueString returns string representation of a value, empty for nil
+func valueString(v any) string {
+	switch vv := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return vv
+	case json.Number:
+		return vv.String()
+	case fmt.Stringer:
+		return vv.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package sendme_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipsusila/sendme"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchema(t *testing.T) {
+	schema, err := sendme.NewSchema([]*sendme.ColumnConfig{
+		{Name: "Email", Aliases: []string{"E-mail"}, Type: sendme.TypeEmail, Required: true},
+		{Name: "Age", Type: sendme.TypeInt},
+		{Name: "Amount", Type: sendme.TypeDecimal, Default: "0"},
+		{Name: "Tanggal", As: "Date", Type: sendme.TypeDate, Layout: "02/01/2006"},
+		{Name: "Active", Type: sendme.TypeBool},
+		{Name: "Grade", Enum: []string{"A", "B", "C"}},
+		{Name: "Code", Pattern: `^[A-Z]{3}-\d+$`},
+		{Name: "Site", Type: sendme.TypeURL},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	md := sendme.MailData{
+		"E-mail":  "alice@example.com",
+		"Age":     int64(30),
+		"Amount":  "",
+		"Tanggal": "17/08/2022",
+		"Active":  "true",
+		"Grade":   "A",
+		"Code":    "INV-001",
+		"Site":    "https://example.com/a",
+	}
+	assert.NoError(t, schema.Apply(md))
+	assert.Equal(t, "alice@example.com", md["Email"])
+	assert.NotContains(t, md, "E-mail")
+	assert.Equal(t, int64(30), md["Age"])
+	assert.True(t, decimal.Zero.Equal(md["Amount"].(decimal.Decimal)))
+	assert.Equal(t, time.Date(2022, 8, 17, 0, 0, 0, 0, time.Local), md["Date"])
+	assert.Equal(t, true, md["Active"])
+
+	md = sendme.MailData{
+		"Email": "",
+		"Age":   "thirty",
+		"Grade": "E",
+		"Code":  "inv-1",
+		"Site":  "example.com",
+	}
+	err = schema.Apply(md)
+	var verr sendme.ValidationError
+	if assert.True(t, errors.As(err, &verr)) {
+		cols := []string{}
+		for _, fe := range verr {
+			cols = append(cols, fe.Column)
+		}
+		assert.Equal(t, []string{"Email", "Age", "Grade", "Code", "Site"}, cols)
+	}
+	// optional columns absent from the row are not added
+	assert.NotContains(t, md, "Date")
+	assert.NotContains(t, md, "Active")
+
+	_, err = sendme.NewSchema([]*sendme.ColumnConfig{{Name: "X", Type: "float"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,306 @@
+package sendme
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// connectError is failure to connect any available server. Reply code
+// of the server is not related to the message, so it is not unwrapped.
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string {
+	return e.err.Error()
+}
+
+// plainAuth is PLAIN authentication, unlike smtp.PlainAuth it is
+// also permitted over unencrypted connection
+type plainAuth struct {
+	username, password, host string
+}
+
+func (a *plainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+	return nil, nil
+}
+
+// loginAuth is LOGIN authentication, username and password are sent
+// as response of server challenges
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", []byte(a.username), nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch {
+	case strings.Contains(string(fromServer), "Username"):
+		return []byte(a.username), nil
+	case strings.Contains(string(fromServer), "Password"):
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected server challenge")
+}
+
+// smtpAuth returns authentication configured for server, nil if none
+func smtpAuth(srv *mail.SMTPServer) smtp.Auth {
+	if srv.Username == "" && srv.Password == "" {
+		return nil
+	}
+	switch srv.Authentication {
+	case mail.AuthPlain:
+		return &plainAuth{username: srv.Username, password: srv.Password, host: srv.Host}
+	case mail.AuthLogin:
+		return &loginAuth{username: srv.Username, password: srv.Password, host: srv.Host}
+	case mail.AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(srv.Username, srv.Password)
+	}
+	return nil
+}
+
+// dialSmtp connects to server, greeting, STARTTLS and authentication
+// are limited by connect timeout
+func dialSmtp(srv *mail.SMTPServer) (*smtp.Client, net.Conn, error) {
+	tc := srv.TLSConfig
+	if tc == nil {
+		tc = &tls.Config{ServerName: srv.Host}
+	}
+	addr := net.JoinHostPort(srv.Host, strconv.Itoa(srv.Port))
+	dialer := net.Dialer{Timeout: srv.ConnectTimeout}
+
+	var conn net.Conn
+	var err error
+	switch srv.Encryption {
+	case mail.EncryptionSSL, mail.EncryptionSSLTLS:
+		conn, err = tls.DialWithDialer(&dialer, "tcp", addr, tc)
+	default:
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if srv.ConnectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(srv.ConnectTimeout))
+	}
+
+	client, err := smtp.NewClient(conn, srv.Host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	helo := srv.Helo
+	if helo == "" {
+		helo = "localhost"
+	}
+	if err := client.Hello(helo); err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("hello error: %w", err)
+	}
+	if srv.Encryption == mail.EncryptionTLS || srv.Encryption == mail.EncryptionSTARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tc); err != nil {
+				client.Close()
+				return nil, nil, fmt.Errorf("STARTTLS error: %w", err)
+			}
+		}
+	}
+	if auth := smtpAuth(srv); auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(auth); err != nil {
+				client.Close()
+				return nil, nil, fmt.Errorf("auth error: %w", err)
+			}
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return client, conn, nil
+}
+
+// smtpConn is keep-alive connection of a worker, connected on demand
+// to the preferred available server
+type smtpConn struct {
+	ui      Ui
+	servers *serverSet
+	current *smtpServer
+	client  *smtp.Client
+	conn    net.Conn
+}
+
+func (c *smtpConn) connect() (*smtp.Client, error) {
+	if c.client != nil {
+		// return to preferred server once its cool down elapsed
+		if !c.servers.preferred(c.current) {
+			return c.client, nil
+		}
+		c.close()
+	}
+	servers := c.servers.candidates()
+	if len(servers) == 0 {
+		return nil, ErrNoServer
+	}
+	var err error
+	for _, srv := range servers {
+		client, conn, cerr := dialSmtp(srv.server)
+		if cerr == nil {
+			c.client, c.conn, c.current = client, conn, srv
+			return client, nil
+		}
+		err = fmt.Errorf("connect to smtp server %s error: %w", srv.name, cerr)
+		c.fail(srv, err)
+	}
+	return nil, &connectError{err: err}
+}
+
+// fail counts failure of server, circuit opening is logged
+func (c *smtpConn) fail(srv *smtpServer, err error) {
+	if c.servers.failure(srv, err) {
+		c.ui.Logf("[WARN] %v, server %s not used for %v\n", err, srv.name, c.servers.coolDown)
+	}
+}
+
+// send sends message and returns reply of the server to the message data.
+// Connection is reset or closed after failure so that it can be used
+// for the next message.
+func (c *smtpConn) send(msg *Message) (int, string, error) {
+	client, err := c.connect()
+	if err != nil {
+		return 0, "", err
+	}
+	if timeout := c.current.server.SendTimeout; timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(timeout))
+		defer func() {
+			if c.conn != nil {
+				c.conn.SetDeadline(time.Time{})
+			}
+		}()
+	}
+	code, reply, err := transmit(client, msg)
+	if err != nil {
+		if isNetworkError(err) {
+			c.fail(c.current, err)
+			c.close()
+		} else if client.Reset() != nil {
+			c.close()
+		}
+		return code, reply, err
+	}
+	c.servers.success(c.current)
+	return code, reply, nil
+}
+
+// transmit runs MAIL, RCPT and DATA commands. Unlike smtp.Client.Data,
+// reply to the end of data is returned.
+func transmit(client *smtp.Client, msg *Message) (int, string, error) {
+	if err := client.Mail(msg.EnvelopeFrom); err != nil {
+		return 0, "", err
+	}
+	for _, rcpt := range msg.Recipients {
+		if err := client.Rcpt(rcpt); err != nil {
+			return 0, "", err
+		}
+	}
+
+	id, err := client.Text.Cmd("DATA")
+	if err != nil {
+		return 0, "", err
+	}
+	client.Text.StartResponse(id)
+	_, _, err = client.Text.ReadResponse(354)
+	client.Text.EndResponse(id)
+	if err != nil {
+		return 0, "", err
+	}
+	w := client.Text.DotWriter()
+	if _, err := w.Write(msg.Raw); err != nil {
+		return 0, "", err
+	}
+	if err := w.Close(); err != nil {
+		return 0, "", err
+	}
+	return client.Text.ReadResponse(250)
+}
+
+func (c *smtpConn) close() {
+	if c.client != nil {
+		c.client.Close()
+		c.client, c.conn = nil, nil
+	}
+}
+
+// smtpTransport sends through keep-alive connections, one per worker
+type smtpTransport struct {
+	conns chan *smtpConn
+	all   []*smtpConn
+}
+
+// newSmtpTransport opens connection of every worker
+func newSmtpTransport(servers *serverSet, workers int, ui Ui) (*smtpTransport, error) {
+	t := smtpTransport{conns: make(chan *smtpConn, workers)}
+	for i := 0; i < workers; i++ {
+		conn := &smtpConn{ui: ui, servers: servers}
+		t.all = append(t.all, conn)
+		if _, err := conn.connect(); err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.conns <- conn
+	}
+	return &t, nil
+}
+
+func (t *smtpTransport) Send(ctx context.Context, msg *Message) (*DeliveryResult, error) {
+	var conn *smtpConn
+	select {
+	case conn = <-t.conns:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { t.conns <- conn }()
+
+	code, reply, err := conn.send(msg)
+	res := DeliveryResult{}
+	if conn.current != nil {
+		res.Server = conn.current.name
+	}
+	if err != nil {
+		return &res, err
+	}
+	res.Code, res.Reply = code, reply
+	return &res, nil
+}
+
+func (t *smtpTransport) Close() error {
+	for _, conn := range t.all {
+		conn.close()
+	}
+	return nil
+}
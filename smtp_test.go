@@ -0,0 +1,510 @@
+package sendme_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipsusila/sendme"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSmtp is a minimal SMTP server recording delivered recipients and
+// messages. Reply of RCPT is given by rcpt function, "drop" closes the connection.
+type fakeSmtp struct {
+	ln        net.Listener
+	mu        sync.Mutex
+	rcpt      func(addr string, n int) string
+	attempts  map[string]int
+	delivered []string
+	messages  []string
+}
+
+func newFakeSmtp(t *testing.T, rcpt func(addr string, n int) string) *fakeSmtp {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fakeSmtp{ln: ln, rcpt: rcpt, attempts: map[string]int{}}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return &s
+}
+
+func (s *fakeSmtp) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSmtp) recipients() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.delivered...)
+}
+
+// data returns content of delivered messages
+func (s *fakeSmtp) data() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+func (s *fakeSmtp) serve(c net.Conn) {
+	defer c.Close()
+	tp := textproto.NewConn(c)
+	tp.PrintfLine("220 fake ESMTP")
+	var rcpts []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 fake")
+		case "MAIL":
+			rcpts = nil
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			addr := strings.Trim(line[strings.Index(line, ":")+1:], " <>")
+			s.mu.Lock()
+			s.attempts[addr]++
+			reply := ""
+			if s.rcpt != nil {
+				reply = s.rcpt(addr, s.attempts[addr])
+			}
+			s.mu.Unlock()
+			switch reply {
+			case "":
+				rcpts = append(rcpts, addr)
+				tp.PrintfLine("250 OK")
+			case "drop":
+				return
+			default:
+				tp.PrintfLine("%s", reply)
+			}
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			lines, err := tp.ReadDotLines()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.delivered = append(s.delivered, rcpts...)
+			s.messages = append(s.messages, strings.Join(lines, "\r\n"))
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK queued")
+		case "RSET", "NOOP":
+			rcpts = nil
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// smtpConfig creates configuration sending data through fake server
+func smtpConfig(t *testing.T, srv *fakeSmtp, data string) *sendme.Config {
+	conf := sendConfig(t, data, "Dear {{.Name}}")
+	conf.Server.Host = "127.0.0.1"
+	conf.Server.Port = srv.port()
+	conf.Delivery.Retry = &sendme.RetryConfig{MaxAttempts: 3, InitialBackoff: "1ms"}
+	return conf
+}
+
+// mimePart is decoded leaf part of a message
+type mimePart struct {
+	contentType string
+	header      textproto.MIMEHeader
+	body        string
+}
+
+// mimeParts returns leaf parts of message in order
+func mimeParts(t *testing.T, raw string) []*mimePart {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	return walkParts(t, textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+func walkParts(t *testing.T, h textproto.MIMEHeader, r io.Reader) []*mimePart {
+	mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	if strings.HasPrefix(mt, "multipart/") {
+		var parts []*mimePart
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return parts
+			}
+			if !assert.NoError(t, err) {
+				return parts
+			}
+			parts = append(parts, walkParts(t, p.Header, p)...)
+		}
+	}
+	// quoted-printable is decoded by multipart reader
+	if strings.EqualFold(h.Get("Content-Transfer-Encoding"), "base64") {
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+	body, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return []*mimePart{{contentType: mt, header: h, body: string(body)}}
+}
+
+func TestHtmlProcessingSmtp(t *testing.T) {
+	srv := newFakeSmtp(t, nil)
+	conf := smtpConfig(t, srv, "Name,Email\nAlice,alice@example.com\n")
+	d := conf.Delivery
+	dir := filepath.Dir(d.TemplateFiles[0])
+	writeFiles(t, dir, map[string]string{
+		"mail.tpl": `<html><head><style>b { color: red }</style></head><body>
+<p>Dear <b>{{.Name}}</b></p><img src="logo.png" alt="Logo"></body></html>`,
+		"logo.png": "PNG",
+	})
+	d.MailFormat = sendme.HtmlFormat
+	d.InlineCss = true
+	d.EmbedImages = true
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, st.NumSentData)
+	messages := srv.data()
+	if !assert.Len(t, messages, 1) {
+		return
+	}
+	assert.Contains(t, messages[0], "multipart/related")
+
+	// image is referenced by content id
+	parts := mimeParts(t, messages[0])
+	if !assert.Len(t, parts, 2) {
+		return
+	}
+	html, image := parts[0], parts[1]
+	assert.Equal(t, "text/html", html.contentType)
+	assert.Contains(t, html.body, `<b style="color: red">Alice</b>`)
+	assert.NotContains(t, html.body, "<style>")
+	assert.Equal(t, "image/png", image.contentType)
+	assert.Equal(t, "PNG", image.body)
+	cid := strings.Trim(image.header.Get("Content-Id"), "<>")
+	assert.Contains(t, html.body, `src="cid:`+cid+`"`)
+}
+
+func TestAlternativeTextSmtp(t *testing.T) {
+	srv := newFakeSmtp(t, nil)
+	conf := smtpConfig(t, srv, "Name,Email\nAlice,alice@example.com\n")
+	d := conf.Delivery
+	dir := filepath.Dir(d.TemplateFiles[0])
+	writeFiles(t, dir, map[string]string{
+		"mail.tpl": `<p>Dear <b>{{.Name}}</b>, see <a href="https://example.com">site</a></p>`,
+	})
+	d.MailFormat = sendme.HtmlFormat
+	d.AutoText = true
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, st.NumSentData)
+	messages := srv.data()
+	if !assert.Len(t, messages, 1) {
+		return
+	}
+	assert.Contains(t, messages[0], "multipart/alternative")
+
+	// text alternative comes before html
+	parts := mimeParts(t, messages[0])
+	if !assert.Len(t, parts, 2) {
+		return
+	}
+	text, html := parts[0], parts[1]
+	assert.Equal(t, "text/plain", text.contentType)
+	assert.Equal(t, "Dear Alice, see site [1]\r\n\r\n[1] https://example.com\r\n", text.body)
+	assert.Equal(t, "text/html", html.contentType)
+	assert.Contains(t, html.body, `<b>Alice</b>`)
+}
+
+func TestPdfAttachmentSmtp(t *testing.T) {
+	srv := newFakeSmtp(t, nil)
+	conf := smtpConfig(t, srv, "Name,Email\nAlice,alice@example.com\nBob,bob@example.com\n")
+	d := conf.Delivery
+	dir := filepath.Dir(d.TemplateFiles[0])
+	writeFiles(t, dir, map[string]string{
+		"certificate.html": `<h1>Certificate</h1><p>awarded to <b>{{.Name}}</b></p>`,
+	})
+	// creation date is taken from the template
+	modTime := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "certificate.html"), modTime, modTime))
+	d.Pdf = []*sendme.PdfConfig{{
+		TemplateFile: filepath.Join(dir, "certificate.html"),
+		FileName:     "certificate-{{.Name}}.pdf",
+	}}
+	d.DuplicateCheck = sendme.DuplicateByHash
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+	messages := srv.data()
+	if !assert.Len(t, messages, 2) {
+		return
+	}
+	parts := mimeParts(t, messages[0])
+	if assert.Len(t, parts, 2) {
+		assert.Equal(t, "application/pdf", parts[1].contentType)
+		assert.Contains(t, parts[1].header.Get("Content-Disposition"), "certificate-")
+		assert.True(t, strings.HasPrefix(parts[1].body, "%PDF-"))
+		assert.Contains(t, parts[1].body, "/CreationDate (D:20240304")
+	}
+
+	// generated PDF is identical in the next run, so message is not sent again
+	mailer, err = sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, st.NumSentData)
+	assert.Equal(t, 2, st.NumAlreadySent)
+	assert.Len(t, srv.data(), 2)
+}
+
+func TestRetry(t *testing.T) {
+	srv := newFakeSmtp(t, func(addr string, n int) string {
+		switch {
+		case addr == "bob@example.com" && n == 1:
+			return "451 4.3.0 try again later"
+		case addr == "dave@example.com" && n == 1:
+			return "drop"
+		case addr == "carol@example.com":
+			return "550 5.1.1 mailbox unavailable"
+		}
+		return ""
+	})
+	conf := smtpConfig(t, srv, "Name,Email\nAlice,alice@example.com\nBob,bob@example.com\n"+
+		"Carol,carol@example.com\nDave,dave@example.com\n")
+	// quota counts messages, retries are not counted again
+	conf.Delivery.RateLimit = &sendme.RateLimitConfig{PerHour: 4, WhenExhausted: sendme.QuotaStop}
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, st.NumSentData)
+	assert.Equal(t, 2, st.NumRetry)
+	assert.Equal(t, 1, st.NumError)
+	assert.Equal(t, 1, st.NumRejected)
+	assert.ElementsMatch(t, []string{"alice@example.com", "bob@example.com", "dave@example.com"}, srv.recipients())
+
+	entries, err := sendme.ReadJournal(conf.Delivery.JournalFile)
+	assert.NoError(t, err)
+	attempts := map[string]int{}
+	for _, e := range entries {
+		attempts[e.Key] = e.Attempts
+		switch e.Key {
+		case "carol@example.com":
+			assert.True(t, e.Rejected())
+			assert.Equal(t, 550, e.Code)
+		case "alice@example.com":
+			// reply of the server to the message data
+			assert.Equal(t, 250, e.Code)
+			assert.Equal(t, "OK queued", e.Reply)
+		}
+	}
+	assert.Equal(t, map[string]int{
+		"alice@example.com": 1,
+		"bob@example.com":   2,
+		"carol@example.com": 1,
+		"dave@example.com":  2,
+	}, attempts)
+
+	// rejected address is not retried by the next run
+	mailer, err = sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, st.NumSentData)
+	assert.Equal(t, 3, st.NumAlreadySent)
+	assert.Equal(t, 1, st.NumSkip)
+
+	// unless listed in resend file
+	resend := filepath.Join(filepath.Dir(conf.Delivery.JournalFile), "resend.txt")
+	assert.NoError(t, os.WriteFile(resend, []byte("carol@example.com\n"), 0644))
+	conf.Delivery.ResendFile = resend
+	mailer, err = sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, st.NumRejected)
+}
+
+func TestFailover(t *testing.T) {
+	// primary accepts connection but drops it on every message
+	primary := newFakeSmtp(t, func(addr string, n int) string { return "drop" })
+	backup := newFakeSmtp(t, nil)
+	conf := smtpConfig(t, backup, "Name,Email\nAlice,alice@example.com\nBob,bob@example.com\n")
+	conf.Servers = []*sendme.ServerConfig{
+		{Name: "backup", Host: "127.0.0.1", Port: backup.port(), Priority: 1},
+		{Name: "primary", Host: "127.0.0.1", Port: primary.port()},
+	}
+	conf.Failover = &sendme.FailoverConfig{MaxFailures: 2, CoolDown: "1h"}
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+	assert.Equal(t, 2, st.NumRetry)
+	assert.Empty(t, primary.recipients())
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com"}, backup.recipients())
+
+	entries, err := sendme.ReadJournal(conf.Delivery.JournalFile)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "backup", entries[0].Server)
+		assert.Equal(t, 3, entries[0].Attempts)
+		assert.Equal(t, "backup", entries[1].Server)
+		assert.Equal(t, 1, entries[1].Attempts)
+	}
+
+	// no server left
+	backup.ln.Close()
+	conf.Servers = conf.Servers[:1]
+	mailer, err = sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = mailer.Send(context.Background())
+	assert.ErrorContains(t, err, "connect to smtp server backup error")
+}
+
+func TestWorkersSmtp(t *testing.T) {
+	srv := newFakeSmtp(t, nil)
+	var sb strings.Builder
+	sb.WriteString("Name,Email\n")
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&sb, "User %d,user%d@example.com\n", i, i)
+	}
+	conf := smtpConfig(t, srv, sb.String())
+	conf.Delivery.Workers = 4
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 30, st.NumSentData)
+	assert.Equal(t, 0, st.NumUnsent)
+	assert.Len(t, srv.recipients(), 30)
+
+	entries, err := sendme.ReadJournal(conf.Delivery.JournalFile)
+	assert.NoError(t, err)
+	keys := map[string]bool{}
+	for _, e := range entries {
+		assert.True(t, e.Delivered(), e.Key)
+		keys[e.Key] = true
+	}
+	assert.Len(t, keys, 30)
+
+	// quota stops the pool, queued messages are counted as unsent
+	srv = newFakeSmtp(t, nil)
+	conf = smtpConfig(t, srv, sb.String())
+	conf.Delivery.Workers = 4
+	conf.Delivery.RateLimit = &sendme.RateLimitConfig{PerHour: 10, WhenExhausted: sendme.QuotaStop}
+	mailer, err = sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err = mailer.Send(context.Background())
+	assert.ErrorIs(t, err, sendme.ErrQuotaExhausted)
+	assert.Equal(t, 10, st.NumSentData)
+	assert.Equal(t, 0, st.NumError)
+	assert.GreaterOrEqual(t, st.NumUnsent, 1)
+	assert.LessOrEqual(t, st.NumSentData+st.NumUnsent, 30)
+	assert.Len(t, srv.recipients(), 10)
+
+	entries, err = sendme.ReadJournal(conf.Delivery.JournalFile)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 10)
+}
+
+func TestFailoverRecovery(t *testing.T) {
+	// primary drops the first message only, circuit opens immediately
+	primary := newFakeSmtp(t, func(addr string, n int) string {
+		if addr == "alice@example.com" {
+			return "drop"
+		}
+		return ""
+	})
+	backup := newFakeSmtp(t, nil)
+	conf := smtpConfig(t, backup, "Name,Email\nAlice,alice@example.com\nBob,bob@example.com\n")
+	conf.Servers = []*sendme.ServerConfig{
+		{Name: "primary", Host: "127.0.0.1", Port: primary.port()},
+		{Name: "backup", Host: "127.0.0.1", Port: backup.port(), Priority: 1},
+	}
+	conf.Failover = &sendme.FailoverConfig{MaxFailures: 1, CoolDown: "300ms"}
+	// retry of alice is before, bob is after cool down
+	conf.Delivery.IntervalBetweenSend = "200ms"
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+	assert.Equal(t, []string{"alice@example.com"}, backup.recipients())
+	assert.Equal(t, []string{"bob@example.com"}, primary.recipients())
+
+	entries, err := sendme.ReadJournal(conf.Delivery.JournalFile)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "backup", entries[0].Server)
+		assert.Equal(t, "primary", entries[1].Server)
+	}
+}
@@ -0,0 +1,336 @@
+package sendme
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RowSource iterates mail data one row at a time,
+// so that large data file is not loaded into memory at once.
+type RowSource interface {
+	// Next returns next row or io.EOF if there is no more row.
+	Next() (MailData, error)
+	// Total returns number of rows if known in advance, otherwise -1.
+	Total() int
+	// Close releases underlying file/connection.
+	Close() error
+}
+
+// OpenRowSource opens configured data source (database or data file)
+func OpenRowSource(conf *Config) (RowSource, error) {
+	if conf == nil || conf.Delivery == nil {
+		// silently return empty data
+		return &sliceSource{}, nil
+	}
+	if ds := conf.Delivery.DataSource; ds != nil && ds.Driver != "" {
+		return openSqlSource(ds)
+	}
+
+	filename := conf.Delivery.DataFile
+	if filename == "" {
+		return &sliceSource{}, nil
+	}
+	return openDataFile(filename, conf.Delivery.Xlsx)
+}
+
+// openDataFile opens data file according to its extension
+func openDataFile(filename string, xlsx *XlsxConfig) (RowSource, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch ext {
+	case ".xlsx":
+		return openXlsxSource(filename, xlsx)
+	case ".csv":
+		return openCsvSource(filename)
+	case ".json":
+		return openJsonSource(filename, true)
+	case ".jsonl", ".ndjson":
+		return openJsonSource(filename, false)
+	case ".yaml", ".yml":
+		return openYamlSource(filename)
+	}
+
+	return nil, fmt.Errorf("unknown file type: %s", filename)
+}
+
+// sliceSource iterates rows already in memory
+type sliceSource struct {
+	data []MailData
+	pos  int
+}
+
+func (s *sliceSource) Next() (MailData, error) {
+	if s.pos >= len(s.data) {
+		return nil, io.EOF
+	}
+	md := s.data[s.pos]
+	s.pos++
+	return md, nil
+}
+func (s *sliceSource) Total() int {
+	return len(s.data)
+}
+func (s *sliceSource) Close() error {
+	return nil
+}
+
+// tableSource maps rows of cells (csv/xlsx) to MailData.
+// Header is the first non-empty row within range, unless specified.
+type tableSource struct {
+	tr       tableRange
+	read     func() ([]string, error)
+	close    func() error
+	row      int
+	firstCol int
+	tags     []string
+	done     bool
+}
+
+func newTableSource(tr tableRange, read func() ([]string, error), close func() error) (*tableSource, error) {
+	t := &tableSource{
+		tr:    tr,
+		read:  read,
+		close: close,
+	}
+	if err := t.readHeader(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// readRow returns next row, io.EOF after the last row in range
+func (t *tableSource) readRow() ([]string, error) {
+	if t.tr.lastRow > 0 && t.row >= t.tr.lastRow {
+		return nil, io.EOF
+	}
+	row, err := t.read()
+	if err != nil {
+		return nil, err
+	}
+	t.row++
+	return row, nil
+}
+
+func (t *tableSource) readHeader() error {
+	for {
+		row, err := t.readRow()
+		if errors.Is(err, io.EOF) {
+			return errors.New("non-empty row/col not found")
+		} else if err != nil {
+			return err
+		}
+
+		if t.tr.headerRow > 0 {
+			if t.row < t.tr.headerRow {
+				continue
+			}
+			if t.tr.isBlank(row) {
+				return fmt.Errorf("header row %d is empty", t.row)
+			}
+		} else if t.row < t.tr.firstRow || t.tr.isBlank(row) {
+			continue
+		}
+
+		// header columns, first column is the first non-empty column
+		// if not specified by range
+		firstCol, lastCol := t.tr.colBounds(len(row))
+		if t.tr.firstCol == 0 {
+			for c := firstCol; c < lastCol; c++ {
+				if row[c] != "" {
+					firstCol = c
+					break
+				}
+			}
+		}
+		t.firstCol = firstCol
+		t.tags = make([]string, 0, lastCol-firstCol)
+		for c := firstCol; c < lastCol; c++ {
+			t.tags = append(t.tags, strings.TrimSpace(row[c]))
+		}
+		return nil
+	}
+}
+
+func (t *tableSource) Next() (MailData, error) {
+	if t.done {
+		return nil, io.EOF
+	}
+	row, err := t.readRow()
+	// rows between separate header row and start of range
+	for err == nil && t.row < t.tr.firstRow {
+		row, err = t.readRow()
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			t.done = true
+		}
+		return nil, err
+	}
+	if t.tr.stopAtBlankRow && t.tr.isBlank(row) {
+		t.done = true
+		return nil, io.EOF
+	}
+
+	ncol := len(row)
+	if t.firstCol+len(t.tags) < ncol {
+		ncol = t.firstCol + len(t.tags)
+	}
+	md := make(MailData)
+	for c := t.firstCol; c < ncol; c++ {
+		key := t.tags[c-t.firstCol]
+		val := strings.TrimSpace(row[c])
+		md[key] = val
+	}
+	return md, nil
+}
+func (t *tableSource) Total() int {
+	return -1
+}
+func (t *tableSource) Close() error {
+	if t.close != nil {
+		return t.close()
+	}
+	return nil
+}
+
+func openCsvSource(filename string) (RowSource, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open csv file %s error: %w", filename, err)
+	}
+
+	rd := csv.NewReader(f)
+	rd.FieldsPerRecord = -1
+	rd.TrimLeadingSpace = true
+	read := func() ([]string, error) {
+		row, err := rd.Read()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("read csv row error: %w", err)
+		}
+		return row, err
+	}
+	return newTableSource(tableRange{}, read, f.Close)
+}
+
+// jsonSource reads array of objects (json) or one object per line (json lines).
+// Nested objects are kept as map.
+type jsonSource struct {
+	f        *os.File
+	dec      *json.Decoder
+	filename string
+	array    bool
+	n        int
+}
+
+func openJsonSource(filename string, array bool) (RowSource, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open json file %s error: %w", filename, err)
+	}
+
+	js := jsonSource{
+		f:        f,
+		dec:      json.NewDecoder(f),
+		filename: filename,
+		array:    array,
+	}
+	js.dec.UseNumber()
+	if array {
+		tok, err := js.dec.Token()
+		if err != nil || tok != json.Delim('[') {
+			f.Close()
+			return nil, fmt.Errorf("decode json file %s error: expecting array of objects", filename)
+		}
+	}
+	return &js, nil
+}
+
+func (j *jsonSource) Next() (MailData, error) {
+	for {
+		if j.array && !j.dec.More() {
+			return nil, io.EOF
+		}
+		j.n++
+		var md MailData
+		if err := j.dec.Decode(&md); err != nil {
+			if !j.array && errors.Is(err, io.EOF) {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("decode json file %s, record #%d error: %w", j.filename, j.n, err)
+		}
+		// skip null entries
+		if md != nil {
+			return md, nil
+		}
+	}
+}
+func (j *jsonSource) Total() int {
+	return -1
+}
+func (j *jsonSource) Close() error {
+	return j.f.Close()
+}
+
+// openYamlSource loads sequence of mappings. Nested mappings are kept as map.
+func openYamlSource(filename string) (RowSource, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open yaml file %s error: %w", filename, err)
+	}
+	defer f.Close()
+
+	var data []MailData
+	if err := yaml.NewDecoder(f).Decode(&data); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("decode yaml file %s error: %w", filename, err)
+	}
+	src := sliceSource{data: make([]MailData, 0, len(data))}
+	for _, md := range data {
+		// skip null entries
+		if md == nil {
+			continue
+		}
+		for key, val := range md {
+			md[key] = yamlValue(val)
+		}
+		src.data = append(src.data, md)
+	}
+	return &src, nil
+}
+
+// yamlValue converts nested mapping to map[string]any, the same as decoded json.
+// Decoder reuses parent type (MailData) or map[any]any for non-string keys.
+func yamlValue(v any) any {
+	switch vv := v.(type) {
+	case MailData:
+		mv := make(map[string]any, len(vv))
+		for key, val := range vv {
+			mv[key] = yamlValue(val)
+		}
+		return mv
+	case map[string]any:
+		for key, val := range vv {
+			vv[key] = yamlValue(val)
+		}
+		return vv
+	case map[any]any:
+		mv := make(map[string]any, len(vv))
+		for key, val := range vv {
+			mv[fmt.Sprint(key)] = yamlValue(val)
+		}
+		return mv
+	case []any:
+		for i, val := range vv {
+			vv[i] = yamlValue(val)
+		}
+		return vv
+	}
+	return v
+}
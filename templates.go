@@ -0,0 +1,226 @@
+package sendme
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template/parse"
+)
+
+// templateFile is a template source, named by its base file name
+type templateFile struct {
+	name  string
+	path  string
+	text  string
+	level int
+}
+
+// Precedence of template files, definitions in higher level
+// (e.g. campaign body) override those in lower level (e.g. block in layout).
+const (
+	levelPartial = iota
+	levelLayout
+	levelMain
+)
+
+// expandTemplatePaths expands directories (files directly inside, hidden
+// files excluded) and glob patterns into sorted list of file names.
+func expandTemplatePaths(paths []string) ([]string, error) {
+	files := []string{}
+	for _, p := range paths {
+		var matches []string
+		if strings.ContainsAny(p, "*?[") {
+			var err error
+			matches, err = filepath.Glob(p)
+			if err != nil {
+				return nil, fmt.Errorf("template pattern %s error: %w", p, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no template file matches %s", p)
+			}
+		} else {
+			matches = []string{p}
+		}
+		sort.Strings(matches)
+
+		for _, match := range matches {
+			fi, err := os.Stat(match)
+			if err != nil {
+				return nil, fmt.Errorf("template file error: %w", err)
+			}
+			if !fi.IsDir() {
+				files = append(files, match)
+				continue
+			}
+			entries, err := os.ReadDir(match)
+			if err != nil {
+				return nil, fmt.Errorf("read template directory %s error: %w", match, err)
+			}
+			for _, e := range entries {
+				if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+					files = append(files, filepath.Join(match, e.Name()))
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// templateSet collects template files of main templates, layout and partials
+type templateSet struct {
+	files []*templateFile
+	// name of template to be executed
+	name string
+	// main template of split set
+	main string
+	// every main template fills its own copy of layout and partials
+	split bool
+}
+
+// newTemplateSet reads templates and checks name collisions.
+// Layout, if given, is executed and main templates fill its blocks.
+// With split, main templates (e.g. A/B variants) are independent of each
+// other and each is parsed with its own copy of layout and partials.
+func newTemplateSet(name string, mains []string, layout string, partials []string, split bool) (*templateSet, error) {
+	ts := templateSet{name: name, main: name}
+	if layout != "" {
+		ts.name = filepath.Base(layout)
+		ts.split = split
+	}
+
+	paths, err := expandTemplatePaths(partials)
+	if err != nil {
+		return nil, err
+	}
+	if err := ts.add(paths, levelPartial); err != nil {
+		return nil, err
+	}
+	if layout != "" {
+		if err := ts.add([]string{layout}, levelLayout); err != nil {
+			return nil, err
+		}
+	}
+	if paths, err = expandTemplatePaths(mains); err != nil {
+		return nil, err
+	}
+	if err := ts.add(paths, levelMain); err != nil {
+		return nil, err
+	}
+	if err := ts.checkDefines(); err != nil {
+		return nil, err
+	}
+
+	return &ts, nil
+}
+
+func (ts *templateSet) add(paths []string, level int) error {
+	for _, path := range paths {
+		name := filepath.Base(path)
+		for _, f := range ts.files {
+			if f.name == name {
+				if sameFile(f.path, path) {
+					return fmt.Errorf("template file %s specified more than once", path)
+				}
+				return fmt.Errorf("template name `%s` collision: %s and %s", name, f.path, path)
+			}
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read template %s error: %w", path, err)
+		}
+		ts.files = append(ts.files, &templateFile{
+			name:  name,
+			path:  path,
+			text:  string(content),
+			level: level,
+		})
+	}
+	return nil
+}
+
+// checkDefines reports templates defined more than once in the same level,
+// template defined in lower level can be overridden.
+func (ts *templateSet) checkDefines() error {
+	type definition struct {
+		path  string
+		level int
+	}
+	defined := map[string]definition{}
+	var shared map[string]definition
+	for _, f := range ts.files {
+		if ts.split && f.level == levelMain {
+			// main templates of split set are checked against layout
+			// and partials only
+			if shared == nil {
+				shared = defined
+			}
+			defined = make(map[string]definition, len(shared))
+			for k, v := range shared {
+				defined[k] = v
+			}
+		}
+		trees := map[string]*parse.Tree{}
+		t := parse.New(f.name)
+		t.Mode = parse.SkipFuncCheck
+		if _, err := t.Parse(f.text, "", "", trees); err != nil {
+			return fmt.Errorf("parse template %s error: %w", f.path, err)
+		}
+
+		names := make([]string, 0, len(trees))
+		for name, tree := range trees {
+			if name != f.name && !parse.IsEmptyTree(tree.Root) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if def, ok := defined[name]; ok && def.level == f.level {
+				return fmt.Errorf("template `%s` defined in both %s and %s", name, def.path, f.path)
+			}
+			defined[name] = definition{path: f.path, level: f.level}
+		}
+	}
+	return nil
+}
+
+// splitTemplates returns true if main templates are selected per row,
+// so that each of them is parsed with its own copy of layout
+func splitTemplates(d *DeliveryConfig) bool {
+	return d.TemplateDataField != "" || len(d.Variants) > 0
+}
+
+// layoutTemplates is a split template set. Executing it runs layout
+// filled by the default main template.
+type layoutTemplates struct {
+	Executer
+	mains map[string]Executer
+}
+
+// withDefault sets main template executed when none is selected,
+// the only main template is the default regardless of its name
+func (lt layoutTemplates) withDefault(name string) (*layoutTemplates, error) {
+	lt.Executer = lt.mains[name]
+	if lt.Executer == nil && len(lt.mains) == 1 {
+		for _, t := range lt.mains {
+			lt.Executer = t
+		}
+	}
+	if lt.Executer == nil {
+		return nil, fmt.Errorf("template `%s` not found", name)
+	}
+	return &lt, nil
+}
+
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
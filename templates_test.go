@@ -0,0 +1,65 @@
+package sendme_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipsusila/sendme"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestTemplateLayout(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"layout.html":            `<html>{{template "header" .}}{{block "content" .}}default{{end}}{{template "footer" .}}</html>`,
+		"lib/header.html":        `{{define "header"}}<h1>{{.Name}}</h1>{{end}}`,
+		"lib/footer.html":        `{{define "footer"}}<p>bye</p>{{end}}`,
+		"campaign/body.html":     `{{define "content"}}<p>Hello {{.Name}}{{template "sign"}}</p>{{end}}`,
+		"campaign/sign.html":     `{{define "sign"}}, team{{end}}`,
+		"other/header.html":      `{{define "header"}}<h2>{{.Name}}</h2>{{end}}`,
+		"dup/content.html":       `{{define "content"}}again{{end}}`,
+		"lib2/header-again.html": `{{define "header"}}<h3>{{.Name}}</h3>{{end}}`,
+	})
+
+	conf := sendme.DefaultConfig()
+	d := conf.Delivery
+	d.TemplateFiles = []string{filepath.Join(dir, "campaign")}
+	d.LayoutFile = filepath.Join(dir, "layout.html")
+	d.PartialPaths = []string{filepath.Join(dir, "lib", "*.html")}
+
+	tpl, err := sendme.ParseHtmlTemplates(conf)
+	if assert.NoError(t, err) {
+		var sb strings.Builder
+		assert.NoError(t, tpl.Execute(&sb, map[string]any{"Name": "Alice"}))
+		assert.Equal(t, "<html><h1>Alice</h1><p>Hello Alice, team</p><p>bye</p></html>", sb.String())
+	}
+
+	// file name collision
+	d.TemplateFiles = []string{filepath.Join(dir, "campaign"), filepath.Join(dir, "other")}
+	_, err = sendme.ParseHtmlTemplates(conf)
+	assert.ErrorContains(t, err, "template name `header.html` collision")
+
+	// define collision in the same level
+	d.TemplateFiles = []string{filepath.Join(dir, "campaign"), filepath.Join(dir, "dup")}
+	_, err = sendme.ParseHtmlTemplates(conf)
+	assert.ErrorContains(t, err, "template `content` defined in both")
+
+	d.TemplateFiles = []string{filepath.Join(dir, "campaign")}
+	d.PartialPaths = []string{filepath.Join(dir, "lib"), filepath.Join(dir, "lib2")}
+	_, err = sendme.ParseTextTemplates(conf)
+	assert.ErrorContains(t, err, "template `header` defined in both")
+
+	d.PartialPaths = []string{filepath.Join(dir, "missing", "*.html")}
+	_, err = sendme.ParseTextTemplates(conf)
+	assert.ErrorContains(t, err, "no template file matches")
+}
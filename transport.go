@@ -0,0 +1,261 @@
+package sendme
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transport type
+const (
+	TransportSmtp     = "SMTP"
+	TransportSendmail = "SENDMAIL"
+	TransportMaildir  = "MAILDIR"
+	TransportMbox     = "MBOX"
+	TransportHttp     = "HTTP"
+)
+
+// TransportConfig selects how messages are delivered. Path is sendmail
+// program, Maildir directory or mbox file according to type.
+type TransportConfig struct {
+	Type string               `json:"type"`
+	Path string               `json:"path"`
+	Args []string             `json:"args"`
+	Http *HttpTransportConfig `json:"http"`
+}
+
+// Message is a fully built message passed to transport
+type Message struct {
+	// envelope sender and recipients (including Bcc)
+	EnvelopeFrom string
+	Recipients   []string
+	// RFC 5322 message, Bcc is not included in headers
+	Raw []byte
+
+	// parts of the message for API transports
+	MessageID   string
+	From        string
+	Sender      string
+	ReplyTo     string
+	To          []string
+	Cc          []string
+	Bcc         []string
+	Subject     string
+	Headers     map[string]string
+	Text        string
+	Html        string
+	Attachments []*AttachmentFile
+}
+
+// DeliveryResult is reported by transport after message is accepted
+type DeliveryResult struct {
+	// name of server or transport which handled the message
+	Server string
+	Code   int
+	Reply  string
+}
+
+// DeliveryError is failure reported by transport with reply code.
+// Temporary failure is retried, permanent one is recorded as rejected.
+type DeliveryError struct {
+	Code      int
+	Message   string
+	Permanent bool
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// Transport delivers messages. Send is called by many workers concurrently.
+type Transport interface {
+	Send(ctx context.Context, msg *Message) (*DeliveryResult, error)
+	Close() error
+}
+
+// SetTransport sets transport used instead of configured one.
+// Transport is not closed by Mailer.
+func (m *Mailer) SetTransport(t Transport) {
+	m.transport = t
+}
+
+// openTransport creates configured transport, SMTP connection of
+// every worker is opened.
+func (m *Mailer) openTransport(workers int) (Transport, error) {
+	tc := m.conf.Transport
+	if tc == nil {
+		tc = &TransportConfig{}
+	}
+	switch strings.ToUpper(tc.Type) {
+	case "", TransportSmtp:
+		return newSmtpTransport(m.servers, workers, m.ui)
+	case TransportSendmail:
+		return newSendmailTransport(tc), nil
+	case TransportMaildir:
+		return newMaildirTransport(tc.Path)
+	case TransportMbox:
+		return &mboxTransport{path: tc.Path}, nil
+	case TransportHttp:
+		return newHttpTransport(tc.Http)
+	}
+	return nil, fmt.Errorf("unknown transport: %s", tc.Type)
+}
+
+// sendmailTransport pipes message to local sendmail program
+type sendmailTransport struct {
+	path string
+	args []string
+}
+
+func newSendmailTransport(tc *TransportConfig) *sendmailTransport {
+	t := sendmailTransport{path: tc.Path, args: tc.Args}
+	if t.path == "" {
+		t.path = "/usr/sbin/sendmail"
+	}
+	if t.args == nil {
+		t.args = []string{"-t", "-i"}
+	}
+	return &t
+}
+
+func (t *sendmailTransport) Send(ctx context.Context, msg *Message) (*DeliveryResult, error) {
+	raw := msg.Raw
+	if len(msg.Bcc) > 0 {
+		// recipients are read from headers (-t), sendmail removes Bcc
+		raw = append([]byte("Bcc: "+strings.Join(msg.Bcc, ", ")+"\r\n"), raw...)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.path, t.args...)
+	cmd.Stdin = bytes.NewReader(raw)
+	cmd.Stderr = &stderr
+	res := DeliveryResult{Server: "sendmail"}
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return &res, ctx.Err()
+		}
+		return &res, sendmailError(err, strings.TrimSpace(stderr.String()))
+	}
+	return &res, nil
+}
+
+// sendmailError classifies exit status of sendmail (sysexits.h).
+// Temporary failures are retried, unknown user/host is rejected,
+// other failures (e.g. usage or configuration error) are not retried.
+func sendmailError(err error, stderr string) error {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return fmt.Errorf("sendmail error: %w", err)
+	}
+	msg := fmt.Sprintf("sendmail exit status %d", ee.ExitCode())
+	if stderr != "" {
+		msg += ": " + stderr
+	}
+	switch ee.ExitCode() {
+	case 69, 71, 74, 75:
+		// EX_UNAVAILABLE, EX_OSERR, EX_IOERR, EX_TEMPFAIL
+		return &DeliveryError{Code: 451, Message: msg}
+	case 67, 68:
+		// EX_NOUSER, EX_NOHOST
+		return &DeliveryError{Code: 550, Message: msg, Permanent: true}
+	}
+	return fmt.Errorf("sendmail error: %s", msg)
+}
+
+func (t *sendmailTransport) Close() error {
+	return nil
+}
+
+// maildirTransport writes every message as file in Maildir new directory
+type maildirTransport struct {
+	dir   string
+	host  string
+	count int64
+}
+
+func newMaildirTransport(dir string) (*maildirTransport, error) {
+	if dir == "" {
+		return nil, errors.New("maildir directory not specified")
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("create maildir %s error: %w", dir, err)
+		}
+	}
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(host)
+	return &maildirTransport{dir: dir, host: host}, nil
+}
+
+func (t *maildirTransport) Send(ctx context.Context, msg *Message) (*DeliveryResult, error) {
+	// unique name: time.pid_counter.host, written to tmp then moved to new
+	name := fmt.Sprintf("%d.%d_%d.%s", time.Now().UnixNano(), os.Getpid(), atomic.AddInt64(&t.count, 1), t.host)
+	tmp := filepath.Join(t.dir, "tmp", name)
+	// maildir messages use local line endings
+	raw := bytes.ReplaceAll(msg.Raw, []byte("\r\n"), []byte("\n"))
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return nil, fmt.Errorf("write maildir message error: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(t.dir, "new", name)); err != nil {
+		return nil, fmt.Errorf("write maildir message error: %w", err)
+	}
+	return &DeliveryResult{Server: "maildir", Reply: name}, nil
+}
+
+func (t *maildirTransport) Close() error {
+	return nil
+}
+
+// mboxTransport appends messages to mbox file
+type mboxTransport struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (t *mboxTransport) Send(ctx context.Context, msg *Message) (*DeliveryResult, error) {
+	if t.path == "" {
+		return nil, errors.New("mbox file not specified")
+	}
+	var buf bytes.Buffer
+	from := msg.EnvelopeFrom
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	fmt.Fprintf(&buf, "From %s %s\n", from, time.Now().UTC().Format(time.ANSIC))
+	scan := bufio.NewScanner(bytes.NewReader(msg.Raw))
+	scan.Buffer(make([]byte, 64*1024), len(msg.Raw)+1)
+	for scan.Scan() {
+		line := strings.TrimSuffix(scan.Text(), "\r")
+		// mboxrd quoting of From lines
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fd, err := os.OpenFile(t.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open mbox %s error: %w", t.path, err)
+	}
+	defer fd.Close()
+	if _, err := fd.Write(buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("write mbox %s error: %w", t.path, err)
+	}
+	return &DeliveryResult{Server: "mbox"}, nil
+}
+
+func (t *mboxTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,408 @@
+package sendme_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipsusila/sendme"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordTransport keeps messages instead of delivering them,
+// error returned by fail (optional) is reported instead.
+type recordTransport struct {
+	mu       sync.Mutex
+	fail     func(msg *sendme.Message) error
+	messages []*sendme.Message
+}
+
+func (r *recordTransport) Send(ctx context.Context, msg *sendme.Message) (*sendme.DeliveryResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := sendme.DeliveryResult{Server: "record"}
+	if r.fail != nil {
+		if err := r.fail(msg); err != nil {
+			return &res, err
+		}
+	}
+	r.messages = append(r.messages, msg)
+	return &res, nil
+}
+
+func (r *recordTransport) Close() error {
+	return nil
+}
+
+// send sends all rows of configuration through recording transport
+func (r *recordTransport) send(t *testing.T, conf *sendme.Config) (sendme.Stats, error) {
+	mailer, err := sendme.NewMailer(conf)
+	if err != nil {
+		return sendme.Stats{}, err
+	}
+	mailer.SetTransport(r)
+	return mailer.Send(context.Background())
+}
+
+func TestTransportErrors(t *testing.T) {
+	conf := sendConfig(t, "Name,Email\nAlice,alice@example.com\nBob,bob@example.com\n"+
+		"Carol,carol@example.com\nDave,dave@example.com\n", "Dear {{.Name}}")
+	d := conf.Delivery
+	d.Retry = &sendme.RetryConfig{MaxAttempts: 3, InitialBackoff: "1ms"}
+	attempts := map[string]int{}
+	tr := recordTransport{fail: func(msg *sendme.Message) error {
+		to := msg.Recipients[0]
+		attempts[to]++
+		switch {
+		case to == "bob@example.com" && attempts[to] == 1:
+			return &sendme.DeliveryError{Code: 421, Message: "busy"}
+		case to == "carol@example.com":
+			return &sendme.DeliveryError{Code: 550, Message: "unknown user", Permanent: true}
+		case to == "dave@example.com":
+			return errors.New("disk full")
+		}
+		return nil
+	}}
+	st, err := tr.send(t, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+	assert.Equal(t, 2, st.NumError)
+	assert.Equal(t, 1, st.NumRetry)
+	assert.Equal(t, 1, st.NumRejected)
+	assert.Len(t, tr.messages, 2)
+	// only temporary failure is retried
+	assert.Equal(t, map[string]int{"alice@example.com": 1, "bob@example.com": 2,
+		"carol@example.com": 1, "dave@example.com": 1}, attempts)
+
+	entries, err := sendme.ReadJournal(d.JournalFile)
+	assert.NoError(t, err)
+	outcomes := map[string]string{}
+	for _, e := range entries {
+		outcomes[e.Key] = e.Outcome
+		assert.Equal(t, "record", e.Server)
+		switch e.Key {
+		case "bob@example.com":
+			assert.Equal(t, 2, e.Attempts)
+		case "carol@example.com":
+			assert.Equal(t, 550, e.Code)
+			assert.Equal(t, "unknown user", e.Reply)
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"alice@example.com": sendme.OutcomeSent,
+		"bob@example.com":   sendme.OutcomeSent,
+		"carol@example.com": sendme.OutcomeRejected,
+		"dave@example.com":  sendme.OutcomeFailed,
+	}, outcomes)
+
+	// rejected address is not sent again, failed one is
+	attempts = map[string]int{}
+	st, err = tr.send(t, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"dave@example.com": 1}, attempts)
+	assert.Equal(t, 2, st.NumAlreadySent)
+}
+
+func TestAddressPolicy(t *testing.T) {
+	header := func(msg *sendme.Message) mail.Header {
+		m, err := mail.ReadMessage(bytes.NewReader(msg.Raw))
+		if !assert.NoError(t, err) {
+			return mail.Header{}
+		}
+		return m.Header
+	}
+
+	for _, policy := range []string{sendme.PolicyMerge, sendme.PolicyReplace} {
+		conf := sendConfig(t, "Name,Email,Manager,Auditor,Office,Assistant\n"+
+			"Alice,alice@example.com,am@example.com,au@example.com,Sales <sales@example.com>,as@example.com\n"+
+			"Bob,bob@example.com,,,,\n", "Dear {{.Name}}")
+		d := conf.Delivery
+		d.AddressPolicy = policy
+		d.CcList = "cc@example.com"
+		d.BccList = "bcc@example.com"
+		d.CcDataField = "Manager"
+		d.BccDataField = "Auditor"
+		d.FromDataField = "Office"
+		d.SenderDataField = "Assistant"
+
+		tr := recordTransport{}
+		_, err := tr.send(t, conf)
+		if !assert.NoError(t, err) || !assert.Len(t, tr.messages, 2) {
+			continue
+		}
+		alice, bob := tr.messages[0], tr.messages[1]
+
+		h := header(alice)
+		assert.Equal(t, "<alice@example.com>", h.Get("To"), policy)
+		assert.Equal(t, `"Sales" <sales@example.com>`, h.Get("From"), policy)
+		assert.Equal(t, "<as@example.com>", h.Get("Sender"), policy)
+		assert.Empty(t, h.Get("Bcc"), policy)
+		assert.Equal(t, "sales@example.com", alice.EnvelopeFrom, policy)
+		if policy == sendme.PolicyMerge {
+			assert.Equal(t, "<cc@example.com>, <am@example.com>", h.Get("Cc"), policy)
+			assert.Equal(t, []string{"<bcc@example.com>", "<au@example.com>"}, alice.Bcc, policy)
+			assert.ElementsMatch(t, []string{"alice@example.com", "cc@example.com", "am@example.com",
+				"bcc@example.com", "au@example.com"}, alice.Recipients, policy)
+		} else {
+			assert.Equal(t, "<am@example.com>", h.Get("Cc"), policy)
+			assert.Equal(t, []string{"<au@example.com>"}, alice.Bcc, policy)
+			assert.ElementsMatch(t, []string{"alice@example.com", "am@example.com", "au@example.com"},
+				alice.Recipients, policy)
+		}
+
+		// empty row fields fall back to global addresses
+		h = header(bob)
+		assert.Equal(t, "<bob@example.com>", h.Get("To"), policy)
+		assert.Equal(t, `"Organizer" <organizer@example.com>`, h.Get("From"), policy)
+		assert.Empty(t, h.Get("Sender"), policy)
+		assert.Empty(t, h.Get("Bcc"), policy)
+		assert.Equal(t, "<cc@example.com>", h.Get("Cc"), policy)
+		assert.Equal(t, []string{"<bcc@example.com>"}, bob.Bcc, policy)
+		assert.ElementsMatch(t, []string{"bob@example.com", "cc@example.com", "bcc@example.com"},
+			bob.Recipients, policy)
+	}
+}
+
+func TestHttpTransportUnreachable(t *testing.T) {
+	api := httptest.NewServer(http.NotFoundHandler())
+	api.Close()
+
+	conf := sendConfig(t, "Name,Email\nAlice,alice@example.com\n", "Dear {{.Name}}")
+	d := conf.Delivery
+	d.Retry = &sendme.RetryConfig{MaxAttempts: 2, InitialBackoff: "1ms"}
+	conf.Server = nil
+	conf.Transport = &sendme.TransportConfig{
+		Type: sendme.TransportHttp,
+		Http: &sendme.HttpTransportConfig{Url: api.URL, Timeout: "1s"},
+	}
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	// connection failure is retried, but not recorded as rejection
+	assert.Equal(t, 1, st.NumError)
+	assert.Equal(t, 1, st.NumRetry)
+	assert.Equal(t, 0, st.NumRejected)
+
+	entries, err := sendme.ReadJournal(d.JournalFile)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, sendme.OutcomeFailed, entries[0].Outcome)
+		assert.Equal(t, 2, entries[0].Attempts)
+	}
+}
+
+func TestHttpTransport(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	delivered := []string{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var p struct {
+			From    string   `json:"from"`
+			To      []string `json:"to"`
+			Subject string   `json:"subject"`
+			Text    string   `json:"text"`
+		}
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&p)) || !assert.Len(t, p.To, 1) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, `"Sender" <sender@example.com>`, p.From)
+		assert.True(t, strings.HasPrefix(p.Text, "Dear "))
+
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[p.To[0]]++
+		switch {
+		case strings.Contains(p.To[0], "bob") && attempts[p.To[0]] == 1:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		case strings.Contains(p.To[0], "carol"):
+			http.Error(w, "invalid recipient", http.StatusUnprocessableEntity)
+		default:
+			delivered = append(delivered, p.To[0])
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"id":"1"}`))
+		}
+	}))
+	defer api.Close()
+
+	conf := sendConfig(t, "Name,Email\nAlice,alice@example.com\nBob,bob@example.com\nCarol,carol@example.com\n", "Dear {{.Name}}")
+	d := conf.Delivery
+	d.From = "Sender <sender@example.com>"
+	d.Retry = &sendme.RetryConfig{MaxAttempts: 3, InitialBackoff: "1ms"}
+	conf.Transport = &sendme.TransportConfig{
+		Type: sendme.TransportHttp,
+		Http: &sendme.HttpTransportConfig{Url: api.URL, Authorization: "Bearer secret"},
+	}
+	conf.Server = nil
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+	assert.Equal(t, 1, st.NumRetry)
+	assert.Equal(t, 1, st.NumRejected)
+	assert.ElementsMatch(t, []string{"<alice@example.com>", "<bob@example.com>"}, delivered)
+
+	entries, err := sendme.ReadJournal(d.JournalFile)
+	assert.NoError(t, err)
+	for _, e := range entries {
+		if e.Key == "carol@example.com" {
+			assert.True(t, e.Rejected())
+			assert.Equal(t, 422, e.Code)
+			assert.Equal(t, "invalid recipient", e.Reply)
+		} else {
+			assert.Equal(t, 202, e.Code)
+		}
+	}
+}
+
+func TestMaildirTransport(t *testing.T) {
+	conf := sendConfig(t, "Name,Email\nAlice,alice@example.com\nBob,bob@example.com\n", "Dear {{.Name}}")
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	conf.Transport = &sendme.TransportConfig{Type: sendme.TransportMaildir, Path: dir}
+	// smtp server is not needed
+	conf.Server, conf.Tls = nil, nil
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+
+	files, err := os.ReadDir(filepath.Join(dir, "new"))
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		content, err := os.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+		assert.NoError(t, err)
+		assert.Contains(t, string(content), "Message-Id: <")
+		// stored with LF line endings, header ends with empty line
+		assert.NotContains(t, string(content), "\r")
+		assert.Contains(t, string(content), "\n\nDear ")
+	}
+}
+
+func TestSendmailTransport(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script is not supported")
+	}
+	// fake sendmail stores message, bob fails temporarily once,
+	// carol is unknown user
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	assert.NoError(t, os.Mkdir(out, 0755))
+	script := filepath.Join(dir, "sendmail")
+	assert.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+msg=$(cat)
+case "$msg" in
+*carol@*) echo "carol: user unknown" >&2; exit 67 ;;
+*bob@*) if [ ! -f "$0.bob" ]; then touch "$0.bob"; echo "queue busy" >&2; exit 75; fi ;;
+esac
+echo "$*" > "`+out+`/args"
+printf '%s' "$msg" > "`+out+`/$$.eml"
+`), 0755))
+
+	conf := sendConfig(t, "Name,Email\nAlice,alice@example.com\nBob,bob@example.com\nCarol,carol@example.com\n", "Dear {{.Name}}")
+	d := conf.Delivery
+	d.BccList = "archive@example.com"
+	d.Retry = &sendme.RetryConfig{MaxAttempts: 3, InitialBackoff: "1ms"}
+	conf.Server = nil
+	conf.Transport = &sendme.TransportConfig{Type: sendme.TransportSendmail, Path: script}
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+	assert.Equal(t, 1, st.NumRetry)
+	assert.Equal(t, 1, st.NumRejected)
+
+	args, err := os.ReadFile(filepath.Join(out, "args"))
+	assert.NoError(t, err)
+	assert.Equal(t, "-t -i\n", string(args))
+	files, err := filepath.Glob(filepath.Join(out, "*.eml"))
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		content, err := os.ReadFile(files[0])
+		assert.NoError(t, err)
+		// recipients are read from headers, including Bcc
+		assert.True(t, strings.HasPrefix(string(content), "Bcc: <archive@example.com>\r\n"))
+	}
+
+	entries, err := sendme.ReadJournal(d.JournalFile)
+	assert.NoError(t, err)
+	for _, e := range entries {
+		assert.Equal(t, "sendmail", e.Server)
+		if e.Key == "carol@example.com" {
+			assert.True(t, e.Rejected())
+			assert.Contains(t, e.Reply, "user unknown")
+		}
+	}
+
+	// missing program is not a rejection
+	conf.Transport.Path = filepath.Join(dir, "missing")
+	d.JournalFile = filepath.Join(dir, "journal2.jsonl")
+	mailer, err = sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err = mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, st.NumError)
+	assert.Equal(t, 0, st.NumRejected)
+	assert.Equal(t, 0, st.NumRetry)
+}
+
+func TestMboxTransport(t *testing.T) {
+	conf := sendConfig(t, "Name,Email\nAlice,alice@example.com\nBob,bob@example.com\n",
+		"Dear {{.Name}}\nFrom now on\n>From quoted")
+	mbox := filepath.Join(t.TempDir(), "sent.mbox")
+	conf.Server = nil
+	conf.Transport = &sendme.TransportConfig{Type: sendme.TransportMbox, Path: mbox}
+
+	mailer, err := sendme.NewMailer(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	st, err := mailer.Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.NumSentData)
+
+	content, err := os.ReadFile(mbox)
+	assert.NoError(t, err)
+	lines := strings.Split(string(content), "\n")
+	separators := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "From ") {
+			separators++
+			assert.True(t, strings.HasPrefix(line, "From organizer@example.com "), line)
+		}
+		assert.NotContains(t, line, "\r")
+	}
+	assert.Equal(t, 2, separators)
+	assert.Contains(t, string(content), "\n\nDear Alice\n>From now on\n>>From quoted")
+	assert.Contains(t, lines, ">From now on")
+	assert.Contains(t, lines, ">>From quoted")
+}
@@ -0,0 +1,132 @@
+package sendme
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+// VariantConfig is a variant of A/B test, rows are split by weight
+type VariantConfig struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	Weight   int    `json:"weight"`
+}
+
+// templateSelector picks template of a row from data field or A/B variants
+type templateSelector struct {
+	tpl      Executer
+	textTpl  Executer
+	markdown *markdownRenderer
+	headers  *headerTemplates
+	field    string
+	variants []*VariantConfig
+	total    int
+}
+
+// selection is the template chosen for a row
+type selection struct {
+	tpl      Executer
+	textTpl  Executer
+	markdown *markdownRenderer
+	headers  *headerTemplates
+	variant  string
+}
+
+func newTemplateSelector(d *DeliveryConfig, tpl, textTpl Executer) (*templateSelector, error) {
+	s := templateSelector{
+		tpl:      tpl,
+		textTpl:  textTpl,
+		field:    d.TemplateDataField,
+		variants: d.Variants,
+	}
+	names := map[string]bool{}
+	for _, v := range d.Variants {
+		if v.Name == "" {
+			return nil, errors.New("variant name must not be empty")
+		}
+		if names[v.Name] {
+			return nil, fmt.Errorf("duplicate variant name: %s", v.Name)
+		}
+		names[v.Name] = true
+		if v.Weight < 0 {
+			return nil, fmt.Errorf("variant %s: weight must not be negative", v.Name)
+		}
+		if v.Template != "" && lookupTemplate(tpl, v.Template) == nil {
+			return nil, fmt.Errorf("variant %s: template `%s` not found", v.Name, v.Template)
+		}
+		s.total += v.Weight
+	}
+	if len(d.Variants) > 0 && s.total == 0 {
+		return nil, errors.New("total weight of variants must be positive")
+	}
+	return &s, nil
+}
+
+// Select returns template of the row. Template named in data field takes
+// precedence, otherwise variant is chosen by hash of recipient address.
+func (s *templateSelector) Select(datum MailData, to string) (*selection, error) {
+	sel := selection{tpl: s.tpl, textTpl: s.textTpl, markdown: s.markdown, headers: s.headers}
+	name := ""
+	if s.field != "" {
+		name = strings.TrimSpace(datum.StringDefault(s.field, ""))
+		sel.variant = name
+	}
+	if name == "" && len(s.variants) > 0 {
+		v := s.pick(to)
+		name = v.Template
+		sel.variant = v.Name
+	}
+	if name == "" {
+		return &sel, nil
+	}
+
+	if sel.tpl = lookupTemplate(s.tpl, name); sel.tpl == nil {
+		return nil, fmt.Errorf("template `%s` not found", name)
+	}
+	if s.textTpl != nil {
+		if t := lookupTemplate(s.textTpl, name); t != nil {
+			sel.textTpl = t
+		}
+	}
+	return &sel, nil
+}
+
+// pick chooses variant deterministically from recipient address
+func (s *templateSelector) pick(to string) *VariantConfig {
+	if list, err := ParseAddressList(to); err == nil && len(list) > 0 {
+		to = list[0].Address
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(strings.TrimSpace(to))))
+	n := int(h.Sum32() % uint32(s.total))
+	for _, v := range s.variants {
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return s.variants[len(s.variants)-1]
+}
+
+// lookupTemplate returns template associated with tpl, nil if not found
+func lookupTemplate(tpl Executer, name string) Executer {
+	switch t := tpl.(type) {
+	case *layoutTemplates:
+		if found, ok := t.mains[name]; ok {
+			return found
+		}
+	case *htmltemplate.Template:
+		if found := t.Lookup(name); found != nil {
+			return found
+		}
+	case *texttemplate.Template:
+		if found := t.Lookup(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
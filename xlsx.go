@@ -0,0 +1,216 @@
+package sendme
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Formula handling for xlsx data file
+const (
+	FormulaCached    = "CACHED"
+	FormulaCalculate = "CALCULATE"
+)
+
+var reCellRef = regexp.MustCompile(`^\$?([A-Za-z]*)\$?([0-9]*)$`)
+
+// tableRange restricts rows/cols which are read from a sheet.
+// All values are 1-based and zero means unbounded.
+type tableRange struct {
+	firstCol       int
+	firstRow       int
+	lastCol        int
+	lastRow        int
+	headerRow      int
+	stopAtBlankRow bool
+}
+
+// parseTableRange parses range, e.g. `B4:H200`, `B4:H` or `B:H`
+func parseTableRange(ref string) (tableRange, error) {
+	tr := tableRange{}
+	if ref = strings.TrimSpace(ref); ref == "" {
+		return tr, nil
+	}
+	first, last, _ := strings.Cut(ref, ":")
+	var err error
+	if tr.firstCol, tr.firstRow, err = parseCellRef(first); err != nil {
+		return tr, fmt.Errorf("invalid range `%s`: %w", ref, err)
+	}
+	if tr.lastCol, tr.lastRow, err = parseCellRef(last); err != nil {
+		return tr, fmt.Errorf("invalid range `%s`: %w", ref, err)
+	}
+	if (tr.lastCol > 0 && tr.lastCol < tr.firstCol) || (tr.lastRow > 0 && tr.lastRow < tr.firstRow) {
+		return tr, fmt.Errorf("invalid range `%s`: end before start", ref)
+	}
+	return tr, nil
+}
+
+// parseCellRef returns 1-based column and row of a (partial) cell reference.
+func parseCellRef(ref string) (col, row int, err error) {
+	m := reCellRef.FindStringSubmatch(strings.TrimSpace(ref))
+	if m == nil {
+		return 0, 0, fmt.Errorf("invalid cell reference `%s`", ref)
+	}
+	if m[1] != "" {
+		if col, err = excelize.ColumnNameToNumber(m[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if m[2] != "" {
+		if row, err = strconv.Atoi(m[2]); err != nil || row < 1 {
+			return 0, 0, fmt.Errorf("invalid row in cell reference `%s`", ref)
+		}
+	}
+	return col, row, nil
+}
+
+// colBounds returns 0-based [first, last) column indices
+func (t tableRange) colBounds(ncols int) (int, int) {
+	return bounds(t.firstCol, t.lastCol, ncols)
+}
+
+func bounds(first, last, n int) (int, int) {
+	lo, hi := 0, n
+	if first > 0 {
+		lo = first - 1
+	}
+	if last > 0 && last < hi {
+		hi = last
+	}
+	if lo > hi {
+		lo = hi
+	}
+	return lo, hi
+}
+
+// isBlank check whether all cells in the range are empty
+func (t tableRange) isBlank(row []string) bool {
+	lo, hi := t.colBounds(len(row))
+	for c := lo; c < hi; c++ {
+		if strings.TrimSpace(row[c]) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// openXlsxSource iterates rows of selected sheet
+func openXlsxSource(filename string, xc *XlsxConfig) (RowSource, error) {
+	if xc == nil {
+		xc = &XlsxConfig{}
+	}
+	tr, err := parseTableRange(xc.Range)
+	if err != nil {
+		return nil, err
+	}
+	tr.headerRow = xc.HeaderRow
+	tr.stopAtBlankRow = xc.StopAtBlankRow
+
+	calc := false
+	switch strings.ToUpper(xc.Formula) {
+	case "", FormulaCached:
+	case FormulaCalculate:
+		calc = true
+	default:
+		return nil, fmt.Errorf("unknown xlsx formula mode: %s", xc.Formula)
+	}
+
+	f, err := excelize.OpenFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open xlsx file %s error: %w", filename, err)
+	}
+	sheet, err := selectSheet(f, xc)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("xlsx file %s: %w", filename, err)
+	}
+	rows, err := f.Rows(sheet)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("method Rows error: %w", err)
+	}
+
+	// cell values are formatted using cell number/date format,
+	// while formula cells return cached result unless calculation requested.
+	opts := excelize.Options{RawCellValue: xc.RawValue}
+	r := 0
+	read := func() ([]string, error) {
+		if !rows.Next() {
+			if err := rows.Error(); err != nil {
+				return nil, fmt.Errorf("read xlsx row error: %w", err)
+			}
+			return nil, io.EOF
+		}
+		r++
+		cols, err := rows.Columns(opts)
+		if err != nil {
+			return nil, fmt.Errorf("read xlsx row %d error: %w", r, err)
+		}
+		if calc {
+			if err := calcFormulas(f, sheet, r, cols); err != nil {
+				return nil, err
+			}
+		}
+		return cols, nil
+	}
+	close := func() error {
+		rows.Close()
+		return f.Close()
+	}
+
+	return newTableSource(tr, read, close)
+}
+
+// selectSheet returns sheet by name, 1-based index or active/first sheet
+func selectSheet(f *excelize.File, xc *XlsxConfig) (string, error) {
+	sheets := f.GetSheetList()
+	if xc.Sheet != "" {
+		if f.GetSheetIndex(xc.Sheet) < 0 {
+			return "", fmt.Errorf("sheet `%s` not found", xc.Sheet)
+		}
+		return xc.Sheet, nil
+	}
+	if xc.SheetIndex > 0 {
+		if xc.SheetIndex > len(sheets) {
+			return "", fmt.Errorf("sheet index %d out of range, number of sheets: %d", xc.SheetIndex, len(sheets))
+		}
+		return sheets[xc.SheetIndex-1], nil
+	}
+
+	// Get active or first sheet
+	sheet := "Sheet1"
+	if idx := f.GetActiveSheetIndex(); idx > 0 {
+		sheet = f.GetSheetName(idx)
+	} else if len(sheets) > 0 {
+		sheet = sheets[0]
+	}
+	return sheet, nil
+}
+
+// calcFormulas replaces value of formula cells in row r (1-based)
+// with calculated result
+func calcFormulas(f *excelize.File, sheet string, r int, row []string) error {
+	for c := range row {
+		cell, err := excelize.CoordinatesToCellName(c+1, r)
+		if err != nil {
+			return err
+		}
+		formula, err := f.GetCellFormula(sheet, cell)
+		if err != nil {
+			return fmt.Errorf("get formula of %s!%s error: %w", sheet, cell, err)
+		}
+		if formula == "" {
+			continue
+		}
+		val, err := f.CalcCellValue(sheet, cell)
+		if err != nil {
+			return fmt.Errorf("calculate %s!%s `%s` error: %w", sheet, cell, formula, err)
+		}
+		row[c] = val
+	}
+	return nil
+}